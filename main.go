@@ -11,8 +11,9 @@ import (
 
 var outFilename string
 var nfadotFile, dfadotFile string
-var autorun, standalone, customError bool
+var autorun, standalone, customError, caseless, noMinimize, strict, conflicts, nodefault, invalidBytes, withContext, withFileSet, setOps bool
 var prefix string
+var backend string
 
 var prefixReplacer *strings.Replacer
 
@@ -26,10 +27,25 @@ func main() {
 	flag.BoolVar(&standalone, "s", false, `standalone code; NN_FUN macro substitution, no Lex() method`)
 	flag.BoolVar(&customError, "e", false, `custom error func; no Error() method`)
 	flag.BoolVar(&autorun, "r", false, `run generated program`)
+	flag.BoolVar(&caseless, "i", false, `case-insensitive rules`)
+	flag.BoolVar(&noMinimize, "nomin", false, `do not minimize DFAs`)
+	flag.BoolVar(&strict, "strict", false, `treat warnings, such as rules that cannot be matched, as errors`)
+	flag.BoolVar(&nodefault, "nodefault", false, `report input that no rule matches, which the lexer then treats as an error instead of discarding it`)
+	flag.BoolVar(&conflicts, "conflicts", false, `report pairs of rules that match the same string, instead of generating code`)
+	flag.BoolVar(&setOps, "setops", false, `read ~ and & in regexes as complement and intersection, rather than as literal characters`)
+	flag.BoolVar(&invalidBytes, "invalid", false, `read bytes that are not valid UTF-8 as themselves, which \e{invalid} matches, rather than as U+FFFD`)
+	flag.BoolVar(&withContext, "context", false, `generate NewLexerContext, for lexers that stop once a context.Context is done`)
+	flag.BoolVar(&withFileSet, "fileset", false, `generate NewLexerFile, Pos and End, for positions in a go/token FileSet`)
+	flag.StringVar(&backend, "backend", "closure", `code generation backend: closure, table, goto or bytes`)
 	flag.StringVar(&nfadotFile, "nfadot", "", `show NFA graph in DOT format`)
 	flag.StringVar(&dfadotFile, "dfadot", "", `show DFA graph in DOT format`)
 	flag.Parse()
 
+	switch backend {
+	case "closure", "table", "goto", "bytes":
+	default:
+		dieIf(true, "nex: unknown backend: "+backend)
+	}
 	if len(prefix) > 0 {
 		prefixReplacer = strings.NewReplacer("yy", prefix)
 	}
@@ -57,7 +73,7 @@ func main() {
 		infile, err = os.Open(flag.Arg(0))
 		dieErr(err, "nex")
 		defer infile.Close()
-		if !autorun {
+		if !autorun && !conflicts {
 			if outFilename == "" {
 				outFilename = basename + ".nn.go"
 				outfile, err = os.Create(outFilename)
@@ -68,7 +84,7 @@ func main() {
 			defer outfile.Close()
 		}
 	}
-	if autorun {
+	if autorun && !conflicts {
 		tmpdir, err := ioutil.TempDir("", "nex")
 		dieIf(err != nil, "tempdir:", err)
 		defer func() {
@@ -82,7 +98,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if autorun {
+	if autorun && !conflicts {
 		c := exec.Command("go", "run", outfile.Name())
 		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
 		dieErr(c.Run(), "go run")
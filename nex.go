@@ -12,6 +12,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 import (
 	"go/format"
@@ -27,6 +29,17 @@ type rule struct {
 	endCode   string
 	kid       []*rule
 	id        string
+	fold      bool     // True if the regex ignores case.
+	trail     []rune   // Trailing context, if any.
+	conds     []string // The start conditions of a top-level rule, if given.
+}
+
+// A start condition, during which the lexer only matches the rules active in
+// it: those naming it, or "*", and for an inclusive condition, those naming no
+// condition.
+type condition struct {
+	name      string
+	exclusive bool
 }
 
 var (
@@ -46,8 +59,39 @@ var (
 	ErrUnexpectedLAngle    = errors.New("unexpected '<'")
 	ErrUnmatchedLAngle     = errors.New("unmatched '<'")
 	ErrUnmatchedRAngle     = errors.New("unmatched '>'")
+	ErrBadRepeatRange      = errors.New("bad range in repetition count")
+	ErrRepeatTooLarge      = errors.New("repetition count too large")
+	ErrBadProperty         = errors.New("unknown Unicode class")
+	ErrBadCodePoint        = errors.New("escaped code point out of range")
+	ErrBadGroupFlag        = errors.New("bad flag in group")
+	ErrBadDefinition       = errors.New("expected name and regex in definition")
+	ErrDuplicateName       = errors.New("name defined twice")
+	ErrUndefinedName       = errors.New("undefined name")
+	ErrDefinitionCycle     = errors.New("definition refers to itself")
+	ErrVariableTrail       = errors.New("trailing context and the text before it both have variable length")
+	ErrEmptyHead           = errors.New("text before trailing context may be empty")
+	ErrEmptyTrail          = errors.New("empty trailing context")
+	ErrAnchorInOperator    = errors.New("anchor in complement or intersection")
+	ErrDeadRule            = errors.New("rule cannot be matched")
+	ErrUncovered           = errors.New("input not covered by any rule")
+	ErrBadCondition        = errors.New("expected names of start conditions")
+	ErrUndefinedCondition  = errors.New("undefined start condition")
+	ErrInvalidOption       = errors.New(`\e{invalid} requires the -invalid option`)
 )
 
+// A lineError is an error found at a given line of the input.
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+// The largest count allowed in a repetition such as {n,m}.
+const maxRepeat = 1000
+
 func ispunct(c rune) bool {
 	for _, r := range "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~" {
 		if c == r {
@@ -89,9 +133,15 @@ type node struct {
 	e      edges // Outedges.
 	n      int   // Index number. Scoped to a family.
 	accept bool  // True if this is an accepting state.
-	set    []int // The NFA nodes represented by a DFA node.
+	rule   int   // The rule accepted by an NFA node.
 }
 
+type nodeSlice []*node
+
+func (p nodeSlice) Len() int           { return len(p) }
+func (p nodeSlice) Less(i, j int) bool { return p[i].n < p[j].n }
+func (p nodeSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 type edges []*edge
 
 func (e edges) Len() int {
@@ -174,213 +224,2058 @@ func inClass(r rune, lim []rune) bool {
 	return false
 }
 
-var dfadot, nfadot *os.File
+// Sorted pairs of limits for the Perl-style classes \d, \s and \w.
+var perlClasses = map[rune][]rune{
+	'd': {'0', '9'},
+	's': {'\t', '\n', '\f', '\r', ' ', ' '},
+	'w': {'0', '9', 'A', 'Z', '_', '_', 'a', 'z'},
+}
 
-func gen(out *bufio.Writer, x *rule) {
-	s := x.regex
-	// Regex -> NFA
-	// We cannot have our alphabet be all Unicode characters. Instead,
-	// we compute an alphabet for each regex:
-	//
-	//   1. Singles: we add single runes used in the regex: any rune not in a
-	//   range. These are held in `sing`.
-	//
-	//   2. Ranges: entire ranges become elements of the alphabet. If ranges in
-	//   the same expression overlap, we break them up into non-overlapping
-	//   ranges. The generated code checks singles before ranges, so there's no
-	//   need to break up a range if it contains a single. These are maintained
-	//   in sorted order in `lim`.
-	//
-	//   3. Wild: we add an element representing all other runes.
-	//
-	// e.g. the alphabet of /[0-9]*[Ee][2-5]*/ is sing: { E, e },
-	// lim: { [0-1], [2-5], [6-9] } and the wild element.
-	sing := make(map[rune]bool)
+// Returns the runes of the Unicode category or script with the given name as
+// sorted pairs of limits, or nil if there is no such class.
+func unicodeClass(name string) []rune {
+	if "Any" == name {
+		return []rune{0, unicode.MaxRune}
+	}
+	if t := unicode.Categories[name]; t != nil {
+		return tableLimits(t)
+	}
+	if t := unicode.Scripts[name]; t != nil {
+		return tableLimits(t)
+	}
+	return nil
+}
+
+// Converts a Unicode range table to sorted pairs of limits, merging adjacent
+// ranges.
+func tableLimits(t *unicode.RangeTable) []rune {
 	var lim []rune
-	var insertLimits func(l, r rune)
-	// Insert a new range [l-r] into `lim`, breaking it up if it overlaps, and
-	// discarding it if it coincides with an existing range. We keep `lim`
-	// sorted.
-	insertLimits = func(l, r rune) {
-		var i int
-		for i = 0; i < len(lim); i += 2 {
-			if l <= lim[i+1] {
-				break
-			}
-		}
-		if len(lim) == i || r < lim[i] {
-			lim = append(lim, 0, 0)
-			copy(lim[i+2:], lim[i:])
-			lim[i] = l
-			lim[i+1] = r
+	add := func(l, r rune) {
+		if n := len(lim); n > 0 && lim[n-1]+1 == l {
+			lim[n-1] = r
 			return
 		}
-		if l < lim[i] {
-			lim = append(lim, 0, 0)
-			copy(lim[i+2:], lim[i:])
-			lim[i+1] = lim[i] - 1
-			lim[i] = l
-			insertLimits(lim[i], r)
-			return
+		lim = append(lim, l, r)
+	}
+	for _, x := range t.R16 {
+		if 1 == x.Stride {
+			add(rune(x.Lo), rune(x.Hi))
+			continue
 		}
-		if l > lim[i] {
-			lim = append(lim, 0, 0)
-			copy(lim[i+2:], lim[i:])
-			lim[i+1] = l - 1
-			lim[i+2] = l
-			insertLimits(l, r)
-			return
+		for c := rune(x.Lo); c <= rune(x.Hi); c += rune(x.Stride) {
+			add(c, c)
 		}
-		// l == lim[i]
-		if r == lim[i+1] {
-			return
+	}
+	for _, x := range t.R32 {
+		if 1 == x.Stride {
+			add(rune(x.Lo), rune(x.Hi))
+			continue
 		}
-		if r < lim[i+1] {
-			lim = append(lim, 0, 0)
-			copy(lim[i+2:], lim[i:])
-			lim[i] = l
-			lim[i+1] = r
-			lim[i+2] = r + 1
-			return
+		for c := rune(x.Lo); c <= rune(x.Hi); c += rune(x.Stride) {
+			add(c, c)
 		}
-		insertLimits(lim[i+1]+1, r)
-	}
-	pos := 0
-	n := 0
-	newNode := func() *node {
-		res := new(node)
-		res.n = n
-		n++
-		return res
 	}
-	newEdge := func(u, v *node) *edge {
-		res := new(edge)
-		res.dst = v
-		u.e = append(u.e, res)
-		sort.Sort(u.e)
-		return res
+	return lim
+}
+
+// Under the -invalid option, each byte of input that is not valid UTF-8 reads
+// as a rune past the last code point, so that rules can tell it apart from
+// U+FFFD. Otherwise it reads as U+FFFD.
+const (
+	minInvalid = unicode.MaxRune + 1
+	maxInvalid = minInvalid + 0xff
+)
+
+// Returns the rune that the given byte reads as when it does not begin a valid
+// UTF-8 sequence.
+func invalidRune(b byte) rune {
+	if invalidBytes {
+		return minInvalid + rune(b)
 	}
-	newStartEdge := func(u, v *node) *edge {
-		res := newEdge(u, v)
-		res.kind = kStart
-		return res
+	return utf8.RuneError
+}
+
+// Returns the last rune that input can read as.
+func maxInput() rune {
+	if invalidBytes {
+		return maxInvalid
 	}
-	newEndEdge := func(u, v *node) *edge {
-		res := newEdge(u, v)
-		res.kind = kEnd
-		return res
+	return unicode.MaxRune
+}
+
+// Returns the pairs of limits of the runes outside the given sorted pairs of
+// limits, up to the last rune that input can read as.
+func complementLimits(lim []rune) []rune {
+	var res []rune
+	next := rune(0)
+	for i := 0; i < len(lim); i += 2 {
+		if lim[i] > next {
+			res = append(res, next, lim[i]-1)
+		}
+		next = lim[i+1] + 1
 	}
-	newWildEdge := func(u, v *node) *edge {
-		res := newEdge(u, v)
-		res.kind = kWild
-		return res
+	if last := maxInput(); next <= last {
+		res = append(res, next, last)
 	}
-	newRuneEdge := func(u, v *node, r rune) *edge {
-		res := newEdge(u, v)
-		res.kind = kRune
-		res.r = r
-		sing[r] = true
-		return res
+	return res
+}
+
+// A foldRun is a set of runes lo, lo+stride, ..., up to hi, each of which is
+// equivalent under Unicode simple case folding to the runes at the offsets in
+// delta from it. A stride of 2 only occurs with a single offset of 1 or -1, as
+// in the alternating capitals and small letters of Latin Extended-A.
+type foldRun struct {
+	lo, hi, stride rune
+	delta          []rune
+}
+
+// The runs of runes that simple case folding affects, sorted by their first
+// rune.
+var foldRuns = newFoldRuns()
+
+func newFoldRuns() []foldRun {
+	var runs []foldRun
+	// Returns true if c extends the given run.
+	extend := func(r *foldRun, delta []rune, c rune) bool {
+		if len(r.delta) != len(delta) {
+			return false
+		}
+		for i := range delta {
+			if r.delta[i] != delta[i] {
+				return false
+			}
+		}
+		if r.lo == r.hi {
+			switch c - r.hi {
+			case 1:
+				r.stride = 1
+			case 2:
+				if len(delta) != 1 || (delta[0] != 1 && delta[0] != -1) {
+					return false
+				}
+				r.stride = 2
+			default:
+				return false
+			}
+		} else if c-r.hi != r.stride {
+			return false
+		}
+		r.hi = c
+		return true
 	}
-	newNilEdge := func(u, v *node) *edge {
-		res := newEdge(u, v)
-		res.kind = kNil
-		return res
+	// Only runes with a case mapping and cased letters, such as U+1FD3, which
+	// only folds to U+0390, fold to others.
+	var lim []rune
+	for _, cr := range unicode.CaseRanges {
+		lim = append(lim, rune(cr.Lo), rune(cr.Hi))
 	}
-	newClassEdge := func(u, v *node) *edge {
-		res := newEdge(u, v)
-		res.kind = kClass
-		res.lim = make([]rune, 0, 2)
-		return res
+	for _, tab := range []*unicode.RangeTable{unicode.Upper, unicode.Lower, unicode.Title} {
+		for _, r := range tab.R16 {
+			lim = append(lim, rune(r.Lo), rune(r.Hi))
+		}
+		for _, r := range tab.R32 {
+			lim = append(lim, rune(r.Lo), rune(r.Hi))
+		}
 	}
-	maybeEscape := func() rune {
-		c := s[pos]
-		if '\\' == c {
-			pos++
-			if len(s) == pos {
-				panic(ErrExtraneousBackslash)
+	lim = normalizeLimits(lim)
+	for i := 0; i < len(lim); i += 2 {
+		for c := lim[i]; c <= lim[i+1]; c++ {
+			var delta []rune
+			for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+				delta = append(delta, f-c)
 			}
-			c = s[pos]
-			switch {
-			case ispunct(c):
-			case escape(c) >= 0:
-				c = escape(s[pos])
-			default:
-				panic(ErrBadBackslash)
+			if delta == nil {
+				continue
+			}
+			// Alternating runs interleave, so try the last two.
+			n := len(runs)
+			if n > 0 && extend(&runs[n-1], delta, c) || n > 1 && extend(&runs[n-2], delta, c) {
+				continue
 			}
+			runs = append(runs, foldRun{c, c, 1, delta})
 		}
-		return c
 	}
-	pcharclass := func() (start, end *node) {
-		start, end = newNode(), newNode()
-		e := newClassEdge(start, end)
-		// Ranges consisting of a single element are a special case:
-		singletonRange := func(c rune) {
-			// 1. The edge-specific 'lim' field always expects endpoints in pairs,
-			// so we must give 'c' as the beginning and the end of the range.
-			e.lim = append(e.lim, c, c)
-			// 2. Instead of updating the regex-wide 'lim' interval set, we add a singleton.
-			sing[c] = true
+	return runs
+}
+
+// Returns the runes in the given pairs of limits together with every rune
+// equivalent to one of them under Unicode simple case folding, as sorted pairs
+// of limits.
+func foldLimits(lim []rune) []rune {
+	res := append([]rune(nil), lim...)
+	for i := 0; i < len(lim); i += 2 {
+		lo, hi := lim[i], lim[i+1]
+		for _, r := range foldRuns {
+			if r.lo > hi {
+				break
+			}
+			// The first and last runes of the run between lo and hi.
+			first, last := r.lo, r.hi
+			if first < lo {
+				first += (lo - first + r.stride - 1) / r.stride * r.stride
+			}
+			if last > hi {
+				last -= (last - hi + r.stride - 1) / r.stride * r.stride
+			}
+			if first > last {
+				continue
+			}
+			// With a stride of 2, the runes between the equivalents of the run
+			// lie in the run, which lies between lo and hi.
+			for _, d := range r.delta {
+				res = append(res, first+d, last+d)
+			}
 		}
-		if len(s) > pos && '^' == s[pos] {
-			e.negate = true
-			pos++
+	}
+	return normalizeLimits(res)
+}
+
+type limitPairs [][2]rune
+
+func (p limitPairs) Len() int           { return len(p) }
+func (p limitPairs) Less(i, j int) bool { return p[i][0] < p[j][0] }
+func (p limitPairs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Sorts pairs of limits, merging those that overlap or are adjacent.
+func normalizeLimits(lim []rune) []rune {
+	var p limitPairs
+	for i := 0; i < len(lim); i += 2 {
+		p = append(p, [2]rune{lim[i], lim[i+1]})
+	}
+	sort.Sort(p)
+	var res []rune
+	for _, x := range p {
+		if n := len(res); n > 0 && x[0] <= res[n-1]+1 {
+			if x[1] > res[n-1] {
+				res[n-1] = x[1]
+			}
+			continue
 		}
-		var left rune
-		leftLive := false
-		justSawDash := false
-		first := true
-		// Allow '-' at the beginning and end, and in ranges.
-		for pos < len(s) && s[pos] != ']' {
-			switch c := maybeEscape(); c {
-			case '-':
-				if first {
-					singletonRange('-')
-					break
-				}
-				justSawDash = true
-			default:
-				if justSawDash {
-					if !leftLive || left > c {
-						panic(ErrBadRange)
-					}
-					e.lim = append(e.lim, left, c)
-					if left == c {
-						sing[c] = true
-					} else {
-						insertLimits(left, c)
-					}
-					leftLive = false
+		res = append(res, x[0], x[1])
+	}
+	return res
+}
+
+// Returns the runes in both of the given sorted pairs of limits.
+func intersectLimits(a, b []rune) []rune {
+	return complementLimits(normalizeLimits(append(complementLimits(a), complementLimits(b)...)))
+}
+
+// Returns the runes on the edges of the NFA reachable from the given node, as
+// sorted pairs of limits.
+func edgeLimits(start *node) []rune {
+	var lim []rune
+	mark := make(map[*node]bool)
+	var visit func(*node)
+	visit = func(u *node) {
+		mark[u] = true
+		for _, e := range u.e {
+			switch e.kind {
+			case kRune:
+				lim = append(lim, e.r, e.r)
+			case kClass:
+				if e.negate {
+					lim = append(lim, complementLimits(normalizeLimits(e.lim))...)
 				} else {
-					if leftLive {
-						singletonRange(left)
-					}
-					left = c
-					leftLive = true
+					lim = append(lim, e.lim...)
 				}
-				justSawDash = false
+			case kWild:
+				lim = append(lim, 0, maxInput())
+			}
+			if !mark[e.dst] {
+				visit(e.dst)
 			}
-			first = false
-			pos++
-		}
-		if leftLive {
-			singletonRange(left)
-		}
-		if justSawDash {
-			singletonRange('-')
 		}
-		return
 	}
-	isNested := false
-	var pre func() (start, end *node)
-	pterm := func() (start, end *node) {
-		if len(s) == pos || s[pos] == '|' {
-			end = newNode()
-			start = end
-			return
-		}
-		switch s[pos] {
-		case '*', '+', '?':
+	visit(start)
+	return normalizeLimits(lim)
+}
+
+// Returns the lengths of the shortest and longest strings matched by the NFA
+// from start to end, where the longest is -1 if there is no bound.
+func lengthRange(start, end *node) (min, max int) {
+	type item struct {
+		u *node
+		k int
+	}
+	// A path longer than the number of nodes must contain a cycle that
+	// consumes input, which we could follow any number of times.
+	count := 0
+	{
+		mark := make(map[*node]bool)
+		var visit func(*node)
+		visit = func(u *node) {
+			mark[u] = true
+			count++
+			for _, e := range u.e {
+				if !mark[e.dst] {
+					visit(e.dst)
+				}
+			}
+		}
+		visit(start)
+	}
+	min, max = -1, -1
+	seen := make(map[item]bool)
+	todo := []item{{start, 0}}
+	seen[todo[0]] = true
+	for len(todo) > 0 {
+		x := todo[0]
+		todo = todo[1:]
+		if x.k > count {
+			return min, -1
+		}
+		if x.u == end {
+			if min == -1 || x.k < min {
+				min = x.k
+			}
+			if x.k > max {
+				max = x.k
+			}
+		}
+		for _, e := range x.u.e {
+			y := item{e.dst, x.k}
+			switch e.kind {
+			case kRune, kClass, kWild:
+				y.k++
+			}
+			if !seen[y] {
+				seen[y] = true
+				todo = append(todo, y)
+			}
+		}
+	}
+	return min, max
+}
+
+// A letter is an element of the alphabet of a regex: a single rune (kRune),
+// the runes of a range that are not singles (kClass), or every rune not
+// otherwise in the alphabet (kWild). The lim field holds the runes of the
+// letter exactly, except for kWild, where it holds the runes excluded.
+type letter struct {
+	kind   int
+	r      rune
+	lim    []rune
+	lo, hi rune // The range for kClass letters.
+}
+
+// Returns the runes of the letter as sorted pairs of limits.
+func (x letter) limits() []rune {
+	switch x.kind {
+	case kRune:
+		return []rune{x.r, x.r}
+	case kClass:
+		return x.lim
+	}
+	return complementLimits(x.lim)
+}
+
+// Returns a rune in the given sorted pairs of limits that can appear in the
+// input, preferring printable ones, and false if there is none.
+func exampleOf(l []rune) (rune, bool) {
+	for i := 0; i < len(l); i += 2 {
+		for r := l[i]; r <= l[i+1] && r < l[i]+128 && r <= unicode.MaxRune; r++ {
+			if unicode.IsPrint(r) {
+				return r, true
+			}
+		}
+	}
+	// Surrogates never appear, and nor do invalid bytes that are ASCII.
+	for i := 0; i < len(l); i += 2 {
+		for _, r := range []rune{l[i], 0xe000, minInvalid + 0x80} {
+			if l[i] <= r && r <= l[i+1] && (r < 0xd800 || 0xe000 <= r && r <= unicode.MaxRune || minInvalid+0x80 <= r) {
+				return r, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Returns the input that the given runes stand for.
+func inputOf(rs []rune) string {
+	var b strings.Builder
+	for _, r := range rs {
+		if r >= minInvalid {
+			b.WriteByte(byte(r - minInvalid))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Returns true if the NFA edge e accepts the runes of the letter x.
+func (x letter) takes(e *edge) bool {
+	switch x.kind {
+	case kRune:
+		return e.kind == kRune && e.r == x.r ||
+			e.kind == kWild ||
+			e.kind == kClass && e.negate != inClass(x.r, e.lim)
+	case kClass:
+		// All runes of the letter behave alike, so any one will do.
+		return e.kind == kWild ||
+			e.kind == kClass && e.negate != inClass(x.lim[0], e.lim)
+	}
+	return e.kind == kWild || (e.kind == kClass && e.negate)
+}
+
+// A dfa is the DFA of a family of rules over the letters of their alphabet.
+// Each state accepts the first rule it matches, so that the runtime finds the
+// longest match, and prefers earlier rules among matches of the same length.
+// The anchors ^ and $ only hold at the start and end of input, so instead of
+// transitions for them, we record the rules accepted at those points.
+type dfa struct {
+	ls       []letter
+	trans    [][]int // trans[i][j] is the state reached from state i on letter j, or -1.
+	acc      []int   // The rule accepted by each state, or -1.
+	eof      []int   // The rule accepted by each state at the end of input, or -1.
+	start    int     // The state at the start of input.
+	startAcc int     // The rule accepted at the start of input, or -1.
+
+	fam  *rule  // The parent of the rules.
+	cut  []int  // The cut of each rule; see the runtime.
+	nest []*dfa // The DFA of the nested family of each rule, if any.
+	// The runes the input may hold: those of the parent rule for a nested
+	// family, as sorted pairs of limits.
+	within []rune
+	// For the DFA of a start condition, the rules active in it, and its name.
+	active []bool
+	cond   string
+
+	// For each rule, the rules accepted first wherever it is accepted.
+	beat map[int]map[int]bool
+	// The shortest tie between each pair of rules that match the same string.
+	ties map[[2]int]*tie
+}
+
+// Reports whether the given rule can match.
+func (d *dfa) isActive(i int) bool {
+	return d.active == nil || d.active[i]
+}
+
+// A tie is a string that two rules match, perhaps only at the start or end of
+// input.
+type tie struct {
+	s              []rune
+	atStart, atEnd bool
+}
+
+// Returns the nodes of the given set together with those reachable from them
+// by nil edges and edges of the given kind, sorted by index.
+func closure(set []*node, kind int) []*node {
+	mark := make(map[*node]bool)
+	var res []*node
+	var visit func(*node)
+	visit = func(u *node) {
+		mark[u] = true
+		res = append(res, u)
+		for _, e := range u.e {
+			if (e.kind == kNil || e.kind == kind) && !mark[e.dst] {
+				visit(e.dst)
+			}
+		}
+	}
+	for _, u := range set {
+		if !mark[u] {
+			visit(u)
+		}
+	}
+	sort.Sort(nodeSlice(res))
+	return res
+}
+
+// Returns the nodes reached from the given set by edges of the given kind.
+func follow(set []*node, kind int) []*node {
+	var res []*node
+	for _, u := range set {
+		for _, e := range u.e {
+			if e.kind == kind {
+				res = append(res, e.dst)
+			}
+		}
+	}
+	return res
+}
+
+// Returns the first rule accepted by a set of NFA nodes, or -1.
+func firstRule(set []*node) int {
+	res := -1
+	for _, u := range set {
+		if u.accept && (-1 == res || u.rule < res) {
+			res = u.rule
+		}
+	}
+	return res
+}
+
+// Converts the NFA of a family with the given start node to a DFA over the
+// given letters by subset construction. State 0 is the start state, except at
+// the start of input, where ^ may also be followed.
+func buildDFA(start *node, ls []letter) *dfa {
+	d := new(dfa)
+	d.ls = ls
+	var sets [][]*node
+	tab := make(map[string]int)
+	add := func(set []*node) int {
+		set = closure(set, kNil)
+		if len(set) == 0 {
+			return -1
+		}
+		var key []byte
+		for _, u := range set {
+			key = strconv.AppendInt(key, int64(u.n), 10)
+			key = append(key, ',')
+		}
+		if i, ok := tab[string(key)]; ok {
+			return i
+		}
+		tab[string(key)] = len(sets)
+		sets = append(sets, set)
+		d.acc = append(d.acc, firstRule(set))
+		// A $ only matches after following at least one $ transition.
+		d.eof = append(d.eof, firstRule(closure(follow(set, kEnd), kEnd)))
+		return len(sets) - 1
+	}
+	add([]*node{start})
+	// Likewise for ^ at the start of input.
+	d.startAcc = firstRule(closure(follow(sets[0], kStart), kStart))
+	d.start = add(closure(sets[0], kStart))
+	for i := 0; i < len(sets); i++ {
+		row := make([]int, len(ls))
+		for j, x := range ls {
+			var set []*node
+			for _, u := range sets[i] {
+				for _, e := range u.e {
+					if x.takes(e) {
+						set = append(set, e.dst)
+					}
+				}
+			}
+			row[j] = add(set)
+		}
+		d.trans = append(d.trans, row)
+	}
+	// Only acceptance after a transition, at the end of input, or after ^ at
+	// the start of input counts, since the runtime never checks the rest.
+	d.beat = make(map[int]map[int]bool)
+	note := func(set []*node) {
+		first := firstRule(set)
+		for _, u := range set {
+			if !u.accept {
+				continue
+			}
+			if d.beat[u.rule] == nil {
+				d.beat[u.rule] = make(map[int]bool)
+			}
+			d.beat[u.rule][first] = true
+		}
+	}
+	// A rule accepted at the end of input competes with any match of the same
+	// length, which comes from the given set.
+	atEnd := func(i int, set []*node) {
+		note(append(closure(follow(sets[i], kEnd), kEnd), set...))
+	}
+	startSet := closure(follow(sets[0], kStart), kStart)
+	note(startSet)
+	atEnd(d.start, startSet)
+	atEnd(0, nil)
+	reached := make([]bool, len(sets))
+	for _, row := range d.trans {
+		for _, k := range row {
+			if -1 != k && !reached[k] {
+				reached[k] = true
+				note(sets[k])
+				atEnd(k, sets[k])
+			}
+		}
+	}
+	// Only the -conflicts option reports ties, and finding them searches the
+	// whole DFA, so other runs skip it. The dead-rule check needs beat.
+	if conflicts {
+		d.findTies(sets, startSet)
+	}
+	return d
+}
+
+// Finds the shortest string on which each pair of rules ties, by searching
+// the DFA breadth first, both from the start of input and from elsewhere,
+// given the node set of each state and the set after ^ at the start of input.
+func (d *dfa) findTies(sets [][]*node, startSet []*node) {
+	d.ties = make(map[[2]int]*tie)
+	type visit struct {
+		state   int
+		s       []rune
+		atStart bool
+	}
+	// Records the ties among the rules accepted by a set.
+	pair := func(set []*node, v visit, atEnd bool) {
+		var rs []int
+		for _, u := range set {
+			if u.accept {
+				rs = append(rs, u.rule)
+			}
+		}
+		sort.Ints(rs)
+		for a := range rs {
+			for b := a + 1; b < len(rs); b++ {
+				key := [2]int{rs[a], rs[b]}
+				if rs[a] != rs[b] && d.ties[key] == nil {
+					d.ties[key] = &tie{v.s, v.atStart, atEnd}
+				}
+			}
+		}
+	}
+	endSet := func(i int, set []*node) []*node {
+		return append(closure(follow(sets[i], kEnd), kEnd), set...)
+	}
+	example := make([]rune, len(d.ls))
+	ok := make([]bool, len(d.ls))
+	for j, x := range d.ls {
+		example[j], ok[j] = exampleOf(x.limits())
+	}
+	// Searching from elsewhere first finds ties that need not be at the start
+	// of input before those that must.
+	queue := []visit{{0, nil, false}}
+	pair(endSet(0, nil), queue[0], true)
+	if d.start != 0 || -1 != firstRule(startSet) {
+		v := visit{d.start, nil, true}
+		queue = append(queue, v)
+		pair(startSet, v, false)
+		pair(endSet(d.start, startSet), v, true)
+	}
+	type place struct {
+		state   int
+		atStart bool
+	}
+	seen := make(map[place]bool)
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		for j, k := range d.trans[v.state] {
+			if -1 == k || !ok[j] || seen[place{k, v.atStart}] {
+				continue
+			}
+			seen[place{k, v.atStart}] = true
+			w := visit{k, append(v.s[:len(v.s):len(v.s)], example[j]), v.atStart}
+			pair(sets[k], w, false)
+			pair(endSet(k, sets[k]), w, true)
+			queue = append(queue, w)
+		}
+	}
+}
+
+// Writes the ties between rules of the given DFAs and those nested within
+// them. The DFAs are those of the start conditions, and of the ties between a
+// pair of rules in different conditions, we write the shortest.
+func writeTies(out *bufio.Writer, ds []*dfa) {
+	fam := ds[0].fam
+	for key := [2]int{}; key[0] < len(fam.kid); key[0]++ {
+		for key[1] = key[0] + 1; key[1] < len(fam.kid); key[1]++ {
+			var x *tie
+			for _, d := range ds {
+				if y := d.ties[key]; y != nil && (x == nil || len(y.s) < len(x.s)) {
+					x = y
+				}
+			}
+			if x != nil {
+				writeTie(out, fam, key, x)
+			}
+		}
+	}
+	for _, x := range nested(ds) {
+		writeTies(out, []*dfa{x})
+	}
+}
+
+// Returns the DFAs of the families nested within the rules of the given DFAs,
+// those of the start conditions, in order. A nested family is alike in every
+// condition where its rule is active, so we take the first.
+func nested(ds []*dfa) []*dfa {
+	var res []*dfa
+	for i := range ds[0].fam.kid {
+		for _, d := range ds {
+			if d.nest != nil && d.nest[i] != nil {
+				res = append(res, d.nest[i])
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Writes a tie between a pair of rules of the given family.
+func writeTie(out *bufio.Writer, fam *rule, key [2]int, x *tie) {
+	where := ""
+	switch {
+	case x.atStart && x.atEnd:
+		where = " as the whole input"
+	case x.atStart:
+		where = " at the start of input"
+	case x.atEnd:
+		where = " at the end of input"
+	}
+	a, b := fam.kid[key[0]].id, fam.kid[key[1]].id
+	fmt.Fprintf(out, "lines %s and %s both match %q%s, and line %s wins\n", a, b, inputOf(x.s), where, a)
+}
+
+// Warnings go to stderr without the timestamps of the log package. Tests
+// replace warnOut to capture them.
+var warnOut io.Writer = os.Stderr
+
+func warnf(format string, a ...interface{}) {
+	fmt.Fprintf(warnOut, format+"\n", a...)
+}
+
+// Warns of the rules of the given DFAs and those nested within them that can
+// never match, because earlier rules in their family match all their strings
+// first, or because they match no input at all. The DFAs are those of the
+// start conditions, and a rule can match if it can in any condition where it
+// is active. In strict mode, the first such rule is an error.
+func checkDeadRules(ds []*dfa) error {
+	var err error
+	var walk func([]*dfa)
+	walk = func(ds []*dfa) {
+		for i, x := range ds[0].fam.kid {
+			live := false
+			var beat map[int]bool
+			for _, d := range ds {
+				if !d.isActive(i) {
+					continue
+				}
+				live = live || d.beat[i][i]
+				for k := range d.beat[i] {
+					if beat == nil {
+						beat = make(map[int]bool)
+					}
+					beat[k] = true
+				}
+			}
+			if live {
+				continue
+			}
+			why := "it matches no input"
+			if beat != nil {
+				var lines []string
+				for k := 0; k < i; k++ {
+					if beat[k] {
+						lines = append(lines, ds[0].fam.kid[k].id)
+					}
+				}
+				if 1 == len(lines) {
+					why = "the rule at line " + lines[0] + " matches its strings first"
+				} else {
+					why = "the rules at lines " + strings.Join(lines, ", ") + " match its strings first"
+				}
+			}
+			warnf("line %s: warning: %v: %s", x.id, ErrDeadRule, why)
+			if strict && err == nil {
+				line, _ := strconv.Atoi(x.id)
+				err = &lineError{line, ErrDeadRule}
+			}
+		}
+		for _, x := range nested(ds) {
+			walk([]*dfa{x})
+		}
+	}
+	walk(ds)
+	return err
+}
+
+// Finds the shortest input that the runtime discards because no rule matches
+// any prefix of it, whatever follows. Returns nil if there is none, and
+// otherwise whether it must be at the end of input for that, and whether it is
+// covered at the start of input.
+func (d *dfa) uncovered() (s []rune, atEnd, atStart bool) {
+	// A state is live if some rule may still be accepted after it.
+	live := make([]bool, len(d.trans))
+	for changed := true; changed; {
+		changed = false
+		for i, row := range d.trans {
+			if live[i] {
+				continue
+			}
+			live[i] = -1 != d.eof[i]
+			for _, k := range row {
+				if -1 != k && (-1 != d.acc[k] || live[k]) {
+					live[i] = true
+				}
+			}
+			changed = changed || live[i]
+		}
+	}
+	example := make([]rune, len(d.ls))
+	ok := make([]bool, len(d.ls))
+	for j, x := range d.ls {
+		example[j], ok[j] = exampleOf(intersectLimits(x.limits(), d.within))
+	}
+	// Reports whether the given letters from the given state reach a match,
+	// or may yet do so.
+	covers := func(st int, js []int, atEnd bool) bool {
+		for _, j := range js {
+			if st = d.trans[st][j]; -1 == st {
+				return false
+			}
+			if -1 != d.acc[st] {
+				return true
+			}
+		}
+		if atEnd {
+			return -1 != d.eof[st]
+		}
+		return live[st]
+	}
+	// Anything covered elsewhere is also covered at the start of input, so we
+	// search from state 0.
+	type visit struct {
+		state int
+		js    []int
+	}
+	queue := []visit{{0, nil}}
+	seen := map[int]bool{0: true}
+	var found []int
+	for len(queue) > 0 && (found == nil || len(queue[0].js) < len(found)) {
+		v := queue[0]
+		queue = queue[1:]
+		for j, k := range d.trans[v.state] {
+			if !ok[j] || -1 != k && -1 != d.acc[k] {
+				continue
+			}
+			w := append(v.js[:len(v.js):len(v.js)], j)
+			if -1 == k || !live[k] {
+				found, atEnd = w, false
+				queue = nil
+				break
+			}
+			if -1 == d.eof[k] && found == nil {
+				found, atEnd = w, true
+			}
+			if !seen[k] {
+				seen[k] = true
+				queue = append(queue, visit{k, w})
+			}
+		}
+	}
+	if found == nil {
+		return nil, false, false
+	}
+	for _, j := range found {
+		s = append(s, example[j])
+	}
+	return s, atEnd, covers(d.start, found, atEnd)
+}
+
+// Warns of the families of rules of the given DFAs and those nested within
+// them that do not cover all input, giving the shortest input that no rule
+// matches. The DFAs are those of the start conditions. In strict mode, the
+// first such family is an error.
+func checkCoverage(ds []*dfa) error {
+	var err error
+	var walk func([]*dfa)
+	walk = func(ds []*dfa) {
+		for _, d := range ds {
+			s, atEnd, atStart := d.uncovered()
+			if s == nil {
+				continue
+			}
+			where, except := "", ""
+			if atEnd {
+				where = " at the end of input"
+			}
+			if atStart {
+				except = " except at the start of input"
+			}
+			if "" != d.cond {
+				warnf("warning: input %q%s is not covered by any rule in start condition %s%s", inputOf(s), where, d.cond, except)
+			} else if "" == d.fam.id {
+				warnf("warning: input %q%s is not covered by any rule%s", inputOf(s), where, except)
+			} else {
+				warnf("line %s: warning: input %q%s is not covered by any rule nested in it%s", d.fam.id, inputOf(s), where, except)
+			}
+			if strict && err == nil {
+				err = ErrUncovered
+				if "" != d.fam.id {
+					line, _ := strconv.Atoi(d.fam.id)
+					err = &lineError{line, ErrUncovered}
+				}
+			}
+		}
+		for _, x := range nested(ds) {
+			walk([]*dfa{x})
+		}
+	}
+	walk(ds)
+	return err
+}
+
+// Minimizes a DFA by merging states that behave alike. States from which no
+// rule can be accepted are replaced by -1, except for state 0 and the start
+// state, which remain.
+func (d *dfa) minimize() {
+	// Refine the partition of states by the rules they accept until it stops
+	// changing. State n stands for -1.
+	n := len(d.trans)
+	block := make([]int, n+1)
+	{
+		tab := make(map[[2]int]int)
+		for i := 0; i <= n; i++ {
+			key := [2]int{-1, -1}
+			if i < n {
+				key = [2]int{d.acc[i], d.eof[i]}
+			}
+			b, ok := tab[key]
+			if !ok {
+				b = len(tab)
+				tab[key] = b
+			}
+			block[i] = b
+		}
+	}
+	count := 0
+	for {
+		tab := make(map[string]int)
+		next := make([]int, n+1)
+		for i := 0; i <= n; i++ {
+			key := fmt.Sprint(block[i])
+			if i < n {
+				for _, k := range d.trans[i] {
+					if -1 == k {
+						k = n
+					}
+					key += fmt.Sprint(",", block[k])
+				}
+			}
+			b, ok := tab[key]
+			if !ok {
+				b = len(tab)
+				tab[key] = b
+			}
+			next[i] = b
+		}
+		block = next
+		if len(tab) == count {
+			break
+		}
+		count = len(tab)
+	}
+	// Renumber the blocks in order of their first states.
+	index := make([]int, n)
+	first := make(map[int]int)
+	var keep []int
+	for i := 0; i < n; i++ {
+		if block[i] == block[n] && i != 0 && i != d.start {
+			index[i] = -1
+			continue
+		}
+		if k, ok := first[block[i]]; ok {
+			index[i] = k
+			continue
+		}
+		first[block[i]] = len(keep)
+		index[i] = len(keep)
+		keep = append(keep, i)
+	}
+	trans := make([][]int, len(keep))
+	acc := make([]int, len(keep))
+	eof := make([]int, len(keep))
+	for k, i := range keep {
+		trans[k] = make([]int, len(d.ls))
+		for j, m := range d.trans[i] {
+			if -1 == m || block[m] == block[n] {
+				trans[k][j] = -1
+			} else {
+				trans[k][j] = index[m]
+			}
+		}
+		acc[k], eof[k] = d.acc[i], d.eof[i]
+	}
+	d.trans, d.acc, d.eof, d.start = trans, acc, eof, index[d.start]
+}
+
+// Returns the start node of a graph of the DFA for writeDotGraph. An unlabeled
+// edge leads to the start state from state 0 if they differ.
+func (d *dfa) graph() *node {
+	nodes := make([]*node, len(d.trans))
+	for i := range nodes {
+		nodes[i] = &node{n: i, accept: -1 != d.acc[i]}
+	}
+	for i, row := range d.trans {
+		for j, k := range row {
+			if -1 == k {
+				continue
+			}
+			e := &edge{kind: d.ls[j].kind, r: d.ls[j].r, dst: nodes[k]}
+			if kClass == e.kind {
+				e.lim = []rune{d.ls[j].lo, d.ls[j].hi}
+			}
+			nodes[i].e = append(nodes[i].e, e)
+		}
+	}
+	if d.start != 0 {
+		nodes[0].e = append(nodes[0].e, &edge{kind: kStart, dst: nodes[d.start]})
+	}
+	return nodes[0]
+}
+
+// Writes a comment listing the rules of the DFA.
+func (d *dfa) writeRules(out *bufio.Writer) {
+	for i, x := range d.fam.kid {
+		if x.trail != nil {
+			fmt.Fprintf(out, "// %d: %v/%v\n", i, string(x.regex), string(x.trail))
+		} else {
+			fmt.Fprintf(out, "// %d: %v\n", i, string(x.regex))
+		}
+	}
+}
+
+func writeInts(out *bufio.Writer, comment string, l []int) {
+	out.WriteString("[]int{  /* " + comment + " */ ")
+	for _, k := range l {
+		fmt.Fprintf(out, " %d,", k)
+	}
+	out.WriteString("}, ")
+}
+
+// Writes the nested families of the DFA, where the given function writes the
+// family of a rule, or nil if there are none.
+func (d *dfa) writeNest(out *bufio.Writer, write func(i int)) {
+	if d.nest == nil {
+		out.WriteString("nil")
+		return
+	}
+	out.WriteString("[]*family{\n")
+	for i, x := range d.nest {
+		if x == nil {
+			out.WriteString("nil")
+		} else {
+			write(i)
+		}
+		out.WriteString(",\n")
+	}
+	out.WriteString("}")
+}
+
+// Returns the letter each letter of the DFA falls back to in the generated
+// code, which checks singles, then ranges, then wild.
+func (d *dfa) fallbacks() []int {
+	wild := len(d.ls) - 1
+	fallback := make([]int, len(d.ls))
+	for j, x := range d.ls {
+		fallback[j] = wild
+		for k, y := range d.ls {
+			if kRune == x.kind && kClass == y.kind && y.lo <= x.r && x.r <= y.hi {
+				fallback[j] = k
+			}
+		}
+	}
+	return fallback
+}
+
+// Writes switch statements on the rune r for the transitions of a row, given
+// the fallbacks of the letters and the code for a transition to each state.
+// We omit cases that lead to the same state as the fallback. Returns the state
+// reached on all other runes.
+func (d *dfa) writeSwitches(out *bufio.Writer, row, fallback []int, target func(int) string) int {
+	wild := len(d.ls) - 1
+	var runeCases, classCases string
+	for j, x := range d.ls {
+		switch x.kind {
+		case kRune:
+			if row[j] != row[fallback[j]] {
+				runeCases += fmt.Sprintf("\t\tcase %d: %s\n", x.r, target(row[j]))
+			}
+		case kClass:
+			if row[j] != row[wild] {
+				classCases += fmt.Sprintf("\t\tcase %d <= r && r <= %d: %s\n",
+					x.lo, x.hi, target(row[j]))
+			}
+		}
+	}
+	if runeCases != "" {
+		out.WriteString("\tswitch(r) {\n" + runeCases + "\t}\n")
+	}
+	if classCases != "" {
+		out.WriteString("\tswitch {\n" + classCases + "\t}\n")
+	}
+	return row[wild]
+}
+
+// Writes the DFA as a Go expression of type *family, where the transitions of
+// each state form a function.
+func (d *dfa) writeClosures(out *bufio.Writer) {
+	out.WriteString("&family{\n")
+	d.writeRules(out)
+	writeInts(out, "Accepted rules", d.acc)
+	writeInts(out, "Rules accepted at end of input", d.eof)
+	out.WriteString("[]func(rune) int{  // Transitions\n")
+	fallback := d.fallbacks()
+	target := func(k int) string {
+		return fmt.Sprintf("return %d", k)
+	}
+	for _, row := range d.trans {
+		out.WriteString("func(r rune) int {\n")
+		fmt.Fprintf(out, "\treturn %v\n},\n", d.writeSwitches(out, row, fallback, target))
+	}
+	fmt.Fprintf(out, "}, %d, %d, ", d.start, d.startAcc)
+	writeInts(out, "Cuts", d.cut)
+	d.writeNest(out, func(i int) {
+		d.nest[i].writeClosures(out)
+	})
+	out.WriteString("}")
+}
+
+// Writes the DFA as a Go expression of type *family, where each state is a
+// labelled block of a function that matches the input bytes. A transition to
+// an accepting state jumps to its label "a", which records the match, and any
+// other transition, or the start of the function, jumps to its label "s".
+func (d *dfa) writeGoto(out *bufio.Writer) {
+	n := len(d.trans)
+	acceptLabel := make([]bool, n)
+	stateLabel := make([]bool, n)
+	stateLabel[d.start] = d.start != 0
+	for _, row := range d.trans {
+		for _, k := range row {
+			if -1 == k {
+				continue
+			}
+			if -1 != d.acc[k] {
+				acceptLabel[k] = true
+			} else {
+				stateLabel[k] = true
+			}
+		}
+	}
+	target := func(k int) string {
+		switch {
+		case -1 == k:
+			return "return matchi, matchn"
+		case -1 != d.acc[k]:
+			return fmt.Sprintf("goto a%d", k)
+		}
+		return fmt.Sprintf("goto s%d", k)
+	}
+	out.WriteString("&family{\n")
+	d.writeRules(out)
+	out.WriteString("func(s *scanner) (int, int) {\n")
+	d.writeMatchStart(out, acceptLabel, stateLabel)
+	fallback := d.fallbacks()
+	for i, row := range d.trans {
+		if acceptLabel[i] {
+			fmt.Fprintf(out, "a%d:\n\tmatchi, matchn = %d, p\n", i, d.acc[i])
+		}
+		if stateLabel[i] {
+			fmt.Fprintf(out, "s%d:\n", i)
+		}
+		out.WriteString("\tif !s.atEOF && (p+utf8.UTFMax <= len(s.buf) || s.more(p)) {\n")
+		// Decode the next rune, unless the state goes nowhere, or ignores it.
+		live, cases := false, false
+		for _, k := range row {
+			live = live || -1 != k
+			cases = cases || k != row[len(row)-1]
+		}
+		switch {
+		case !live:
+		case cases:
+			out.WriteString("\tr, n := rune(s.buf[p]), 1\n")
+			out.WriteString("\tif r >= utf8.RuneSelf {\n\t\tr, n = utf8.DecodeRuneInString(s.buf[p:])\n")
+			if invalidBytes {
+				out.WriteString("\t\tif n == 1 {\n\t\t\tr = invalidByte + rune(s.buf[p])\n\t\t}\n")
+			}
+			out.WriteString("\t}\n")
+			out.WriteString("\tp += n\n")
+		default:
+			out.WriteString("\tif s.buf[p] < utf8.RuneSelf {\n\t\tp++\n\t} else {\n")
+			out.WriteString("\t\t_, n := utf8.DecodeRuneInString(s.buf[p:])\n\t\tp += n\n\t}\n")
+		}
+		out.WriteString("\t" + target(d.writeSwitches(out, row, fallback, target)) + "\n")
+		out.WriteString("\t}\n")
+		// Handle $.
+		if k := d.eof[i]; -1 != k {
+			fmt.Fprintf(out, "\tif matchn < p || matchi > %d {\n\t\tmatchi, matchn = %d, p\n\t}\n", k, k)
+		}
+		out.WriteString("\treturn matchi, matchn\n")
+	}
+	out.WriteString("}, ")
+	writeInts(out, "Cuts", d.cut)
+	d.writeNest(out, func(i int) {
+		d.nest[i].writeGoto(out)
+	})
+	out.WriteString("}")
+}
+
+// Writes the start of a function that matches input by jumping between the
+// labelled blocks of the states of the DFA, given which labels are in use.
+func (d *dfa) writeMatchStart(out *bufio.Writer, acceptLabel, stateLabel []bool) {
+	out.WriteString("\tmatchi, matchn, p := 0, -1, 0\n")
+	out.WriteString("\tif !s.started {\n\t\ts.started = true\n")
+	if -1 != d.startAcc {
+		fmt.Fprintf(out, "\t\tmatchi, matchn = %d, 0\n", d.startAcc)
+	}
+	if d.start != 0 {
+		fmt.Fprintf(out, "\t\tgoto s%d\n", d.start)
+	}
+	out.WriteString("\t}\n")
+	// Skip the label of state 0 that records a match.
+	if acceptLabel[0] {
+		stateLabel[0] = true
+		out.WriteString("\tgoto s0\n")
+	}
+}
+
+// Rune equivalence classes: runes in the same class behave alike in every DFA
+// of the spec, so transition tables need only one column per class.
+type runeClasses struct {
+	lo     []rune         // The first rune of each range of runes, in order.
+	of     []int          // The class of each range.
+	n      int            // The number of classes.
+	letter map[*dfa][]int // The letter of each class, for each DFA.
+}
+
+// Returns the first rune of each range of runes that the DFA treats alike, in
+// order, along with the letter of the range.
+func (d *dfa) ranges() (lo []rune, letter []int) {
+	// Pairs of the first rune of a range and its letter.
+	var p limitPairs
+	for j, x := range d.ls {
+		var l []rune
+		switch x.kind {
+		case kRune:
+			l = []rune{x.r, x.r}
+		case kClass:
+			l = x.lim
+		default:
+			l = complementLimits(x.lim)
+		}
+		for i := 0; i < len(l); i += 2 {
+			p = append(p, [2]rune{l[i], rune(j)})
+		}
+	}
+	sort.Sort(p)
+	for _, x := range p {
+		lo = append(lo, x[0])
+		letter = append(letter, int(x[1]))
+	}
+	return lo, letter
+}
+
+// Computes the rune classes of the given DFAs and those nested within them.
+func newRuneClasses(roots []*dfa) *runeClasses {
+	var ds []*dfa
+	var walk func(*dfa)
+	walk = func(d *dfa) {
+		ds = append(ds, d)
+		for _, x := range d.nest {
+			if x != nil {
+				walk(x)
+			}
+		}
+	}
+	for _, d := range roots {
+		walk(d)
+	}
+	// Split the runes into ranges at the start of every range of every DFA.
+	los := make([][]rune, len(ds))
+	letters := make([][]int, len(ds))
+	start := make(map[rune]bool)
+	for i, d := range ds {
+		los[i], letters[i] = d.ranges()
+		for _, r := range los[i] {
+			start[r] = true
+		}
+	}
+	var bounds []rune
+	for r := range start {
+		bounds = append(bounds, r)
+	}
+	sort.Sort(RuneSlice(bounds))
+	// Runes lie in the same class when they lie in the same letter of every
+	// DFA.
+	c := &runeClasses{letter: make(map[*dfa][]int)}
+	tab := make(map[string]int)
+	pos := make([]int, len(ds))
+	for _, r := range bounds {
+		key := ""
+		for i := range ds {
+			for pos[i]+1 < len(los[i]) && los[i][pos[i]+1] <= r {
+				pos[i]++
+			}
+			key += fmt.Sprint(letters[i][pos[i]], ",")
+		}
+		k, ok := tab[key]
+		if !ok {
+			k = len(tab)
+			tab[key] = k
+			for i, d := range ds {
+				c.letter[d] = append(c.letter[d], letters[i][pos[i]])
+			}
+		}
+		if n := len(c.of); n > 0 && c.of[n-1] == k {
+			continue
+		}
+		c.lo = append(c.lo, r)
+		c.of = append(c.of, k)
+	}
+	c.n = len(tab)
+	return c
+}
+
+// Returns the class of a rune.
+func (c *runeClasses) class(r rune) int {
+	i := sort.Search(len(c.lo), func(i int) bool { return c.lo[i] > r })
+	return c.of[i-1]
+}
+
+// Writes the tables the runtime uses to find the class of a rune.
+func (c *runeClasses) write(out *bufio.Writer) {
+	out.WriteString("\nvar runeClassLatin1 = [256]int{")
+	for r := rune(0); r < 256; r++ {
+		fmt.Fprintf(out, " %d,", c.class(r))
+	}
+	out.WriteString("}\n\nvar runeClassLo = []rune{")
+	for _, r := range c.lo {
+		fmt.Fprintf(out, " %d,", r)
+	}
+	out.WriteString("}\n\nvar runeClassOf = []int{")
+	for _, k := range c.of {
+		fmt.Fprintf(out, " %d,", k)
+	}
+	out.WriteString("}\n")
+}
+
+// Compresses the transitions of the DFA on rune classes by row displacement.
+// Each state has a default transition, the most common one in its row. We
+// store the others in next at the offset base[s] of the state s, and record
+// s at the same place in check, so that the rows of different states may
+// interleave.
+func (d *dfa) compress(c *runeClasses) (base, def, next, check []int) {
+	letter := c.letter[d]
+	base = make([]int, len(d.trans))
+	def = make([]int, len(d.trans))
+	size := c.n
+	for s, row := range d.trans {
+		count := make(map[int]int)
+		def[s] = row[letter[0]]
+		for _, j := range letter {
+			count[row[j]]++
+			if count[row[j]] > count[def[s]] {
+				def[s] = row[j]
+			}
+		}
+		var cols []int
+		for k, j := range letter {
+			if row[j] != def[s] {
+				cols = append(cols, k)
+			}
+		}
+		// Find the first offset where the row fits.
+		b := 0
+	fit:
+		for ; ; b++ {
+			for _, k := range cols {
+				if b+k < len(check) && check[b+k] != -1 {
+					continue fit
+				}
+			}
+			break
+		}
+		base[s] = b
+		for _, k := range cols {
+			for len(check) <= b+k {
+				check = append(check, -1)
+				next = append(next, -1)
+			}
+			check[b+k] = s
+			next[b+k] = row[letter[k]]
+		}
+		if b+c.n > size {
+			size = b + c.n
+		}
+	}
+	// Pad the tables so that every lookup lies within them.
+	for len(check) < size {
+		check = append(check, -1)
+		next = append(next, -1)
+	}
+	return base, def, next, check
+}
+
+// Writes the DFA as a Go expression of type *family, where the transitions
+// form compressed tables over the given rune classes.
+func (d *dfa) writeTables(out *bufio.Writer, c *runeClasses) {
+	out.WriteString("&family{\n")
+	d.writeRules(out)
+	writeInts(out, "Accepted rules", d.acc)
+	writeInts(out, "Rules accepted at end of input", d.eof)
+	out.WriteString("\n")
+	base, def, next, check := d.compress(c)
+	writeInts(out, "Base", base)
+	writeInts(out, "Default", def)
+	writeInts(out, "Next", next)
+	writeInts(out, "Check", check)
+	fmt.Fprintf(out, "\n%d, %d, ", d.start, d.startAcc)
+	writeInts(out, "Cuts", d.cut)
+	d.writeNest(out, func(i int) {
+		d.nest[i].writeTables(out, c)
+	})
+	out.WriteString("}")
+}
+
+// A byteDFA is a DFA over the bytes of UTF-8 input, compiled from a DFA over
+// runes. Its first states are those of the rune DFA, and the rest lie inside
+// the encoding of a rune. It reads input as the rune DFA would: each byte that
+// does not begin a valid encoding reads on its own, as U+FFFD or, under the
+// -invalid option, as an invalid byte.
+type byteDFA struct {
+	d     *dfa
+	trans [][]int   // trans[i][b] is the state reached from state i on byte b, -1, or breakOff.
+	back  []backOff // What each state inside a rune does when its encoding breaks off.
+	nest  []*byteDFA
+}
+
+// The transition from a state inside a rune on a byte that breaks off its
+// encoding.
+const breakOff = -2
+
+// When the encoding of a rune breaks off, at an invalid byte or the end of
+// input, the bytes read since the start of the rune are each invalid. A
+// backOff sums up the effect of reading them: it records a match of the rule
+// that ends n bytes back, unless the rule is -1, then continues from the state
+// on the byte that broke off the encoding, or stops if the state is -1.
+type backOff struct {
+	rule, n, state int
+}
+
+// The first rune of each length of encoding.
+var utf8Min = []rune{0, 0, 0x80, 0x800, 0x10000}
+
+func newByteDFA(d *dfa) *byteDFA {
+	n := len(d.trans)
+	b := &byteDFA{d: d, trans: make([][]int, n), back: make([]backOff, n)}
+	lo, letter := d.ranges()
+	find := func(r rune) int {
+		return sort.Search(len(lo), func(k int) bool { return lo[k] > r }) - 1
+	}
+	// Returns the state reached from state i on rune r.
+	step := func(i int, r rune) int {
+		if -1 == i {
+			return -1
+		}
+		return d.trans[i][letter[find(r)]]
+	}
+	// Returns the state reached from state i on every rune from l to h, if
+	// they all reach the same one.
+	uniform := func(i int, l, h rune) (int, bool) {
+		k := find(l)
+		t := d.trans[i][letter[k]]
+		for k++; k < len(lo) && lo[k] <= h; k++ {
+			if d.trans[i][letter[k]] != t {
+				return 0, false
+			}
+		}
+		return t, true
+	}
+	// Returns the backOff of a state k bytes into a rune started at state i.
+	backOffFrom := func(i, k int) backOff {
+		x := backOff{-1, 0, i}
+		for j := 1; j <= k && -1 != x.state; j++ {
+			x.state = step(x.state, invalidRune(0x80))
+			if j < k && -1 != x.state && -1 != d.acc[x.state] {
+				x.rule, x.n = d.acc[x.state], k-j
+			}
+		}
+		return x
+	}
+	// States inside runes with the same transitions and backOff are the same.
+	tab := make(map[string]int)
+	add := func(row []int, back backOff) int {
+		dead := -1 == back.rule && -1 == back.state
+		for _, k := range row {
+			dead = dead && (-1 == k || breakOff == k)
+		}
+		if dead {
+			return -1
+		}
+		key := fmt.Sprint(back, row)
+		if k, ok := tab[key]; ok {
+			return k
+		}
+		k := len(b.trans)
+		tab[key] = k
+		b.trans = append(b.trans, row)
+		b.back = append(b.back, back)
+		return k
+	}
+	// Returns the state k bytes into a rune started at state i, whose
+	// remaining m bytes pick one of the runes from l on. Blocks of runes that
+	// all reach the same state need only be built once.
+	type block struct{ i, k, m, t int }
+	memo := make(map[block]int)
+	var inside func(i, k, m int, l rune) int
+	inside = func(i, k, m int, l rune) int {
+		size := rune(1) << (6 * uint(m-1)) // The runes of each next byte.
+		h := l + 64*size - 1
+		t, ok := uniform(i, l, h)
+		ok = ok && l >= utf8Min[k+m] && h <= unicode.MaxRune && (h < 0xD800 || l > 0xDFFF)
+		if ok {
+			if x, ok := memo[block{i, k, m, t}]; ok {
+				return x
+			}
+		}
+		row := make([]int, 256)
+		for c := range row {
+			row[c] = breakOff
+		}
+		for c := 0; c < 64; c++ {
+			r := l + rune(c)*size
+			switch {
+			case r < utf8Min[k+m] || r > unicode.MaxRune || 0xD800 <= r && r <= 0xDFFF:
+			case 1 == m:
+				row[0x80+c] = step(i, r)
+			default:
+				row[0x80+c] = inside(i, k+1, m-1, r)
+			}
+		}
+		x := add(row, backOffFrom(i, k))
+		if ok {
+			memo[block{i, k, m, t}] = x
+		}
+		return x
+	}
+	for i := 0; i < n; i++ {
+		row := make([]int, 256)
+		for c := range row {
+			switch {
+			case c < utf8.RuneSelf:
+				row[c] = step(i, rune(c))
+			case c < 0xC2 || c > 0xF4:
+				// Rules cannot tell invalid bytes apart, so any will do.
+				row[c] = step(i, invalidRune(0x80))
+			case c < 0xE0:
+				row[c] = inside(i, 1, 1, rune(c&0x1F)<<6)
+			case c < 0xF0:
+				row[c] = inside(i, 1, 2, rune(c&0x0F)<<12)
+			default:
+				row[c] = inside(i, 1, 3, rune(c&0x07)<<18)
+			}
+		}
+		b.trans[i] = row
+	}
+	if d.nest != nil {
+		b.nest = make([]*byteDFA, len(d.nest))
+		for i, x := range d.nest {
+			if x != nil {
+				b.nest[i] = newByteDFA(x)
+			}
+		}
+	}
+	return b
+}
+
+// Returns the class of each byte, where bytes in the same class behave alike
+// in every state of the given byte DFAs and those nested within them.
+func byteClasses(roots []*byteDFA) []int {
+	var rows [][]int
+	var walk func(*byteDFA)
+	walk = func(b *byteDFA) {
+		rows = append(rows, b.trans...)
+		for _, x := range b.nest {
+			if x != nil {
+				walk(x)
+			}
+		}
+	}
+	for _, b := range roots {
+		walk(b)
+	}
+	class := make([]int, 256)
+	tab := make(map[string]int)
+	for c := range class {
+		var key []byte
+		for _, row := range rows {
+			key = strconv.AppendInt(key, int64(row[c]), 10)
+			key = append(key, ',')
+		}
+		k, ok := tab[string(key)]
+		if !ok {
+			k = len(tab)
+			tab[string(key)] = k
+		}
+		class[c] = k
+	}
+	return class
+}
+
+// Writes the table the runtime uses to find the class of a byte.
+func writeByteClasses(out *bufio.Writer, class []int) {
+	out.WriteString("\nvar byteClass = [256]uint8{")
+	for _, k := range class {
+		fmt.Fprintf(out, " %d,", k)
+	}
+	out.WriteString("}\n")
+}
+
+// Writes the byte DFA as a Go expression of type *family, as writeGoto does,
+// except that the states switch on the class of the next byte, and states
+// inside a rune have the label "u".
+func (b *byteDFA) write(out *bufio.Writer, class []int) {
+	d := b.d
+	n := len(d.trans)
+	acceptLabel := make([]bool, n)
+	stateLabel := make([]bool, n)
+	stateLabel[d.start] = d.start != 0
+	use := func(k int) {
+		switch {
+		case k < 0 || k >= n:
+		case -1 != d.acc[k]:
+			acceptLabel[k] = true
+		default:
+			stateLabel[k] = true
+		}
+	}
+	for i, row := range b.trans {
+		for _, k := range row {
+			use(k)
+		}
+		if i >= n {
+			use(b.back[i].state)
+		}
+	}
+	target := func(k int) string {
+		switch {
+		case -1 == k:
+			return "return matchi, matchn"
+		case k >= n:
+			return fmt.Sprintf("p++\n\tgoto u%d", k)
+		case -1 != d.acc[k]:
+			return fmt.Sprintf("p++\n\tgoto a%d", k)
+		}
+		return fmt.Sprintf("p++\n\tgoto s%d", k)
+	}
+	// The code for a state inside a rune when its encoding breaks off.
+	backOffCode := func(i int) string {
+		x := b.back[i]
+		s := ""
+		if -1 != x.rule {
+			s = fmt.Sprintf("matchi, matchn = %d, p-%d\n\t", x.rule, x.n)
+		}
+		// The state reads the byte that broke off the encoding again.
+		return s + strings.TrimPrefix(target(x.state), "p++\n\t")
+	}
+	// Representative bytes of each class.
+	var reps []int
+	seen := make(map[int]bool)
+	for c, k := range class {
+		if !seen[k] {
+			seen[k] = true
+			reps = append(reps, c)
+		}
+	}
+	out.WriteString("&family{\n")
+	d.writeRules(out)
+	out.WriteString("func(s *scanner) (int, int) {\n")
+	d.writeMatchStart(out, acceptLabel, stateLabel)
+	for i, row := range b.trans {
+		if i < n {
+			if acceptLabel[i] {
+				fmt.Fprintf(out, "a%d:\n\tmatchi, matchn = %d, p\n", i, d.acc[i])
+			}
+			if stateLabel[i] {
+				fmt.Fprintf(out, "s%d:\n", i)
+			}
+		} else {
+			fmt.Fprintf(out, "u%d:\n", i)
+		}
+		// The most common transition over classes is the default.
+		count := make(map[int]int)
+		def := row[reps[0]]
+		for _, c := range reps {
+			count[row[c]]++
+			if count[row[c]] > count[def] {
+				def = row[c]
+			}
+		}
+		// Even a state that goes nowhere looks for the end of input, which
+		// tells the runtime whether to scan again after the match.
+		out.WriteString("\tif !s.atEOF && (p < len(s.buf) || s.more(p)) {\n")
+		{
+			if len(count) > 1 {
+				out.WriteString("\tswitch byteClass[s.buf[p]] {\n")
+				// List the cases in order of their first class.
+				cases := make(map[int]string)
+				var order []int
+				for _, c := range reps {
+					if k := row[c]; k != def {
+						if _, ok := cases[k]; !ok {
+							order = append(order, k)
+						}
+						cases[k] += fmt.Sprintf(", %d", class[c])
+					}
+				}
+				for _, k := range order {
+					code := backOffCode(i)
+					if breakOff != k {
+						code = target(k)
+					}
+					fmt.Fprintf(out, "\tcase %s:\n\t%s\n", cases[k][2:], code)
+				}
+				out.WriteString("\t}\n")
+			}
+			if breakOff != def {
+				out.WriteString("\t" + target(def) + "\n")
+			}
+			out.WriteString("\t}\n")
+		}
+		if i >= n {
+			out.WriteString("\t" + backOffCode(i) + "\n")
+			continue
+		}
+		// Handle $.
+		if k := d.eof[i]; -1 != k {
+			fmt.Fprintf(out, "\tif matchn < p || matchi > %d {\n\t\tmatchi, matchn = %d, p\n\t}\n", k, k)
+		}
+		out.WriteString("\treturn matchi, matchn\n")
+	}
+	out.WriteString("}, ")
+	writeInts(out, "Cuts", d.cut)
+	d.writeNest(out, func(i int) {
+		b.nest[i].write(out, class)
+	})
+	out.WriteString("}")
+}
+
+var dfadot, nfadot *os.File
+
+// Compiles the family of rules that are the children of fam, along with any
+// nested families, to a DFA. If active is not nil, only the rules it marks
+// can match, though all of them remain in the family. Trailing context that
+// cannot be cut from a match is an error at the line of its rule.
+func compileFamily(fam *rule, active []bool) (*dfa, error) {
+	// The regex being parsed.
+	var s []rune
+	// True while parsing a part of the regex that ignores case.
+	fold := false
+	// Regex -> NFA
+	// We cannot have our alphabet be all Unicode characters. Instead,
+	// we compute an alphabet for each family:
+	//
+	//   1. Singles: we add single runes used in the regex: any rune not in a
+	//   range. These are held in `sing`.
+	//
+	//   2. Ranges: entire ranges become elements of the alphabet. If ranges in
+	//   the same expression overlap, we break them up into non-overlapping
+	//   ranges. The generated code checks singles before ranges, so there's no
+	//   need to break up a range if it contains a single. These are maintained
+	//   in sorted order in `lim`.
+	//
+	//   3. Wild: we add an element representing all other runes.
+	//
+	// e.g. the alphabet of /[0-9]*[Ee][2-5]*/ is sing: { E, e },
+	// lim: { [0-1], [2-5], [6-9] } and the wild element.
+	sing := make(map[rune]bool)
+	var lim []rune
+	var insertLimits func(l, r rune)
+	// Insert a new range [l-r] into `lim`, breaking it up if it overlaps, and
+	// discarding it if it coincides with an existing range. We keep `lim`
+	// sorted.
+	insertLimits = func(l, r rune) {
+		var i int
+		for i = 0; i < len(lim); i += 2 {
+			if l <= lim[i+1] {
+				break
+			}
+		}
+		if len(lim) == i || r < lim[i] {
+			lim = append(lim, 0, 0)
+			copy(lim[i+2:], lim[i:])
+			lim[i] = l
+			lim[i+1] = r
+			return
+		}
+		if l < lim[i] {
+			lim = append(lim, 0, 0)
+			copy(lim[i+2:], lim[i:])
+			lim[i+1] = lim[i] - 1
+			lim[i] = l
+			insertLimits(lim[i], r)
+			return
+		}
+		if l > lim[i] {
+			lim = append(lim, 0, 0)
+			copy(lim[i+2:], lim[i:])
+			lim[i+1] = l - 1
+			lim[i+2] = l
+			insertLimits(l, r)
+			return
+		}
+		// l == lim[i]
+		if r == lim[i+1] {
+			return
+		}
+		if r < lim[i+1] {
+			lim = append(lim, 0, 0)
+			copy(lim[i+2:], lim[i:])
+			lim[i] = l
+			lim[i+1] = r
+			lim[i+2] = r + 1
+			return
+		}
+		insertLimits(lim[i+1]+1, r)
+	}
+	pos := 0
+	n := 0
+	newNode := func() *node {
+		res := new(node)
+		res.n = n
+		n++
+		return res
+	}
+	newEdge := func(u, v *node) *edge {
+		res := new(edge)
+		res.dst = v
+		u.e = append(u.e, res)
+		sort.Sort(u.e)
+		return res
+	}
+	newStartEdge := func(u, v *node) *edge {
+		res := newEdge(u, v)
+		res.kind = kStart
+		return res
+	}
+	newEndEdge := func(u, v *node) *edge {
+		res := newEdge(u, v)
+		res.kind = kEnd
+		return res
+	}
+	newWildEdge := func(u, v *node) *edge {
+		res := newEdge(u, v)
+		res.kind = kWild
+		return res
+	}
+	newRuneEdge := func(u, v *node, r rune) *edge {
+		res := newEdge(u, v)
+		res.kind = kRune
+		res.r = r
+		sing[r] = true
+		return res
+	}
+	newNilEdge := func(u, v *node) *edge {
+		res := newEdge(u, v)
+		res.kind = kNil
+		return res
+	}
+	newClassEdge := func(u, v *node) *edge {
+		res := newEdge(u, v)
+		res.kind = kClass
+		res.lim = make([]rune, 0, 2)
+		return res
+	}
+	// Read a number in the given base from the runes following pos, leaving pos
+	// at its last digit. There must be between min and max digits.
+	pnumber := func(base, min, max int) rune {
+		var c rune
+		k := 0
+		for ; k < max && pos+1 < len(s); k++ {
+			d := strings.IndexRune("0123456789abcdef", unicode.ToLower(s[pos+1]))
+			if d < 0 || d >= base {
+				break
+			}
+			if c <= unicode.MaxRune {
+				c = c*rune(base) + rune(d)
+			}
+			pos++
+		}
+		if k < min {
+			panic(ErrBadBackslash)
+		}
+		return c
+	}
+	maybeEscape := func() rune {
+		c := s[pos]
+		if '\\' == c {
+			pos++
+			if len(s) == pos {
+				panic(ErrExtraneousBackslash)
+			}
+			c = s[pos]
+			switch {
+			case ispunct(c):
+			case escape(c) >= 0:
+				c = escape(s[pos])
+			case 'x' == c:
+				if pos+1 < len(s) && '{' == s[pos+1] {
+					pos++
+					c = pnumber(16, 1, 8)
+					if pos+1 == len(s) || '}' != s[pos+1] {
+						panic(ErrBadBackslash)
+					}
+					pos++
+				} else {
+					c = pnumber(16, 2, 2)
+				}
+			case 'u' == c:
+				c = pnumber(16, 4, 4)
+			case '0' == c:
+				c = pnumber(8, 0, 2)
+			default:
+				panic(ErrBadBackslash)
+			}
+			if c > unicode.MaxRune || 0xd800 <= c && c <= 0xdfff {
+				panic(ErrBadCodePoint)
+			}
+		}
+		return c
+	}
+	// Add sorted pairs of limits to the alphabet.
+	addLimits := func(l []rune) {
+		for i := 0; i < len(l); i += 2 {
+			if l[i] == l[i+1] {
+				sing[l[i]] = true
+			} else {
+				insertLimits(l[i], l[i+1])
+			}
+		}
+	}
+	// Parse a class escape such as \d, \W, \pL, \p{Greek}, \P{Han} or
+	// \e{invalid} at pos, leaving pos at its last rune. Returns false if there
+	// is none.
+	pclassEscape := func() (l []rune, negate, ok bool) {
+		if pos+1 >= len(s) || '\\' != s[pos] {
+			return
+		}
+		switch s[pos+1] {
+		case 'p', 'P':
+			negate = 'P' == s[pos+1]
+			pos += 2
+			if len(s) == pos {
+				panic(ErrBadProperty)
+			}
+			name := string(s[pos])
+			if '{' == s[pos] {
+				i := pos + 1
+				for i < len(s) && '}' != s[i] {
+					i++
+				}
+				if len(s) == i {
+					panic(ErrUnmatchedLBrace)
+				}
+				name = string(s[pos+1 : i])
+				pos = i
+			}
+			if l = unicodeClass(name); l == nil {
+				panic(ErrBadProperty)
+			}
+			return l, negate, true
+		case 'd', 'D', 's', 'S', 'w', 'W':
+			negate = unicode.IsUpper(s[pos+1])
+			pos++
+			return perlClasses[unicode.ToLower(s[pos])], negate, true
+		case 'e':
+			// The bytes of input that are not valid UTF-8.
+			const name = "{invalid}"
+			if pos+2+len(name) > len(s) || name != string(s[pos+2:pos+2+len(name)]) {
+				panic(ErrBadBackslash)
+			}
+			if !invalidBytes {
+				panic(ErrInvalidOption)
+			}
+			pos += 1 + len(name)
+			return []rune{minInvalid, maxInvalid}, false, true
+		}
+		return
+	}
+	pcharclass := func() (start, end *node) {
+		start, end = newNode(), newNode()
+		e := newClassEdge(start, end)
+		// Ranges consisting of a single element are a special case:
+		singletonRange := func(c rune) {
+			// 1. The edge-specific 'lim' field always expects endpoints in pairs,
+			// so we must give 'c' as the beginning and the end of the range.
+			e.lim = append(e.lim, c, c)
+			// 2. Instead of updating the regex-wide 'lim' interval set, we add a singleton.
+			sing[c] = true
+		}
+		if len(s) > pos && '^' == s[pos] {
+			e.negate = true
+			pos++
+		}
+		var left rune
+		leftLive := false
+		justSawDash := false
+		first := true
+		// Allow '-' at the beginning and end, and in ranges.
+		for pos < len(s) && s[pos] != ']' {
+			if l, negate, ok := pclassEscape(); ok {
+				// A class cannot be the endpoint of a range.
+				if justSawDash {
+					panic(ErrBadRange)
+				}
+				if leftLive {
+					singletonRange(left)
+					leftLive = false
+				}
+				if negate {
+					l = complementLimits(l)
+				}
+				e.lim = append(e.lim, l...)
+				addLimits(l)
+				first = false
+				pos++
+				continue
+			}
+			// An escaped hyphen, such as \- or \x2d, is always literal.
+			escaped := '\\' == s[pos]
+			switch c := maybeEscape(); {
+			case '-' == c && !escaped:
+				if first {
+					singletonRange('-')
+					break
+				}
+				justSawDash = true
+			default:
+				if justSawDash {
+					if !leftLive || left > c {
+						panic(ErrBadRange)
+					}
+					e.lim = append(e.lim, left, c)
+					if left == c {
+						sing[c] = true
+					} else {
+						insertLimits(left, c)
+					}
+					leftLive = false
+				} else {
+					if leftLive {
+						singletonRange(left)
+					}
+					left = c
+					leftLive = true
+				}
+				justSawDash = false
+			}
+			first = false
+			pos++
+		}
+		if leftLive {
+			singletonRange(left)
+		}
+		if justSawDash {
+			singletonRange('-')
+		}
+		if fold {
+			e.lim = foldLimits(e.lim)
+			addLimits(e.lim)
+		}
+		return
+	}
+	isNested := false
+	var pre func() (start, end *node)
+	pterm := func() (start, end *node) {
+		if len(s) == pos || s[pos] == '|' || setOps && s[pos] == '&' {
+			end = newNode()
+			start = end
+			return
+		}
+		switch s[pos] {
+		case '*', '+', '?':
 			panic(ErrBareClosure)
 		case ')':
 			if !isNested {
@@ -391,10 +2286,20 @@ func gen(out *bufio.Writer, x *rule) {
 			return
 		case '(':
 			pos++
+			oldFold := fold
+			// The only flag we support is case folding, as in (?i:...).
+			if pos < len(s) && '?' == s[pos] {
+				if pos+2 >= len(s) || 'i' != s[pos+1] || ':' != s[pos+2] {
+					panic(ErrBadGroupFlag)
+				}
+				fold = true
+				pos += 3
+			}
 			oldIsNested := isNested
 			isNested = true
 			start, end = pre()
 			isNested = oldIsNested
+			fold = oldFold
 			if len(s) == pos || ')' != s[pos] {
 				panic(ErrUnmatchedLpar)
 			}
@@ -415,14 +2320,106 @@ func gen(out *bufio.Writer, x *rule) {
 			if len(s) == pos || ']' != s[pos] {
 				panic(ErrUnmatchedLbkt)
 			}
-		default:
-			start, end = newNode(), newNode()
-			newRuneEdge(start, end, maybeEscape())
+		default:
+			start, end = newNode(), newNode()
+			if l, negate, ok := pclassEscape(); ok {
+				if fold {
+					l = foldLimits(l)
+				}
+				e := newClassEdge(start, end)
+				e.lim = l
+				e.negate = negate
+				addLimits(l)
+				break
+			}
+			c := maybeEscape()
+			if fold && unicode.SimpleFold(c) != c {
+				e := newClassEdge(start, end)
+				e.lim = foldLimits([]rune{c, c})
+				addLimits(e.lim)
+				break
+			}
+			newRuneEdge(start, end, c)
+		}
+		pos++
+		return
+	}
+	// Parse a counted repetition such as {2}, {2,} or {2,5} at pos, returning
+	// the bounds and the position just past the closing brace. The maximum is
+	// -1 if there is no upper bound. For compatibility with specs where '{' is
+	// an ordinary rune, anything not of this form is not a repetition.
+	prepeat := func() (min, max, next int, ok bool) {
+		i := pos + 1
+		number := func() int {
+			n := -1
+			for ; i < len(s) && '0' <= s[i] && s[i] <= '9'; i++ {
+				if n < 0 {
+					n = 0
+				}
+				if n <= maxRepeat {
+					n = 10*n + int(s[i]-'0')
+				}
+			}
+			return n
+		}
+		if min = number(); min < 0 || i == len(s) {
+			return
+		}
+		max = min
+		if ',' == s[i] {
+			i++
+			max = number()
+			if i == len(s) {
+				return
+			}
 		}
-		pos++
-		return
+		if '}' != s[i] {
+			return
+		}
+		if min > maxRepeat || max > maxRepeat {
+			panic(ErrRepeatTooLarge)
+		}
+		if max != -1 && max < min {
+			panic(ErrBadRepeatRange)
+		}
+		return min, max, i + 1, true
+	}
+	// Expand a counted repetition of the term beginning at p, whose first copy
+	// runs from start to end. We obtain further copies by parsing the term
+	// again.
+	repeat := func(p int, start, end *node, min, max int) (*node, *node) {
+		k := max
+		if max == -1 {
+			k = min + 1
+		}
+		nstart := newNode()
+		cur := nstart
+		var skip []*node
+		for i := 0; i < k; i++ {
+			if i > 0 {
+				save := pos
+				pos = p
+				start, end = pterm()
+				pos = save
+			}
+			if i >= min {
+				skip = append(skip, cur)
+			}
+			newNilEdge(cur, start)
+			if max == -1 && i == k-1 {
+				newNilEdge(end, start)
+			}
+			cur = end
+		}
+		nend := newNode()
+		newNilEdge(cur, nend)
+		for _, v := range skip {
+			newNilEdge(v, nend)
+		}
+		return nstart, nend
 	}
 	pclosure := func() (start, end *node) {
+		p := pos
 		start, end = pterm()
 		if start == end {
 			return
@@ -431,6 +2428,14 @@ func gen(out *bufio.Writer, x *rule) {
 			return
 		}
 		switch s[pos] {
+		case '{':
+			min, max, next, ok := prepeat()
+			if !ok {
+				return
+			}
+			start, end = repeat(p, start, end, min, max)
+			pos = next
+			return
 		case '*':
 			newNilEdge(end, start)
 			nend := newNode()
@@ -452,9 +2457,175 @@ func gen(out *bufio.Writer, x *rule) {
 		pos++
 		return
 	}
+	// Compute the letters of the alphabet so far.
+	letters := func() []letter {
+		var res []letter
+		var runes []rune
+		for r := range sing {
+			runes = append(runes, r)
+		}
+		sort.Sort(RuneSlice(runes))
+		other := make([]rune, 0, 2*len(runes)+len(lim))
+		for _, r := range runes {
+			res = append(res, letter{kind: kRune, r: r})
+			other = append(other, r, r)
+		}
+		for j := 0; j < len(lim); j += 2 {
+			var l []rune
+			lo := lim[j]
+			for _, r := range runes {
+				if r < lo || r > lim[j+1] {
+					continue
+				}
+				if r > lo {
+					l = append(l, lo, r-1)
+				}
+				lo = r + 1
+			}
+			if lo <= lim[j+1] {
+				l = append(l, lo, lim[j+1])
+			}
+			// Skip ranges consisting entirely of singles.
+			if l != nil {
+				res = append(res, letter{kind: kClass, lim: l, lo: lim[j], hi: lim[j+1]})
+			}
+		}
+		other = append(other, lim...)
+		return append(res, letter{kind: kWild, lim: normalizeLimits(other)})
+	}
+	// Add an edge from u to v accepting exactly the runes of letter x.
+	newLetterEdge := func(u, v *node, x letter) {
+		switch x.kind {
+		case kRune:
+			newRuneEdge(u, v, x.r)
+		case kClass:
+			newClassEdge(u, v).lim = x.lim
+		default:
+			e := newClassEdge(u, v)
+			e.lim = x.lim
+			e.negate = true
+		}
+	}
+	// Convert the NFA from start to end into a DFA over the alphabet so far,
+	// for complement and intersection. The DFA has no missing transitions:
+	// trans[i][j] is the state reached from state i on letter j, and state 0 is
+	// the start state.
+	subDFA := func(start, end *node, ls []letter) (acc []bool, trans [][]int) {
+		var sets [][]*node
+		tab := make(map[string]int)
+		add := func(set map[*node]bool) int {
+			var todo []*node
+			for u := range set {
+				todo = append(todo, u)
+			}
+			for len(todo) > 0 {
+				u := todo[len(todo)-1]
+				todo = todo[:len(todo)-1]
+				for _, e := range u.e {
+					switch e.kind {
+					case kStart, kEnd:
+						panic(ErrAnchorInOperator)
+					case kNil:
+						if !set[e.dst] {
+							set[e.dst] = true
+							todo = append(todo, e.dst)
+						}
+					}
+				}
+			}
+			var ids []int
+			for u := range set {
+				ids = append(ids, u.n)
+			}
+			sort.Ints(ids)
+			key := fmt.Sprint(ids)
+			if i, ok := tab[key]; ok {
+				return i
+			}
+			tab[key] = len(sets)
+			var v []*node
+			for u := range set {
+				v = append(v, u)
+			}
+			sets = append(sets, v)
+			acc = append(acc, set[end])
+			return len(sets) - 1
+		}
+		add(map[*node]bool{start: true})
+		for i := 0; i < len(sets); i++ {
+			row := make([]int, len(ls))
+			for j, x := range ls {
+				set := make(map[*node]bool)
+				for _, u := range sets[i] {
+					for _, e := range u.e {
+						if e.kind != kNil && x.takes(e) {
+							set[e.dst] = true
+						}
+					}
+				}
+				row[j] = add(set)
+			}
+			trans = append(trans, row)
+		}
+		return acc, trans
+	}
+	// Turn a DFA back into an NFA, omitting states that cannot reach an
+	// accepting state.
+	fromDFA := func(acc []bool, trans [][]int, ls []letter) (start, end *node) {
+		live := make([]bool, len(acc))
+		for changed := true; changed; {
+			changed = false
+			for i, row := range trans {
+				if live[i] {
+					continue
+				}
+				live[i] = acc[i]
+				for _, j := range row {
+					live[i] = live[i] || live[j]
+				}
+				changed = changed || live[i]
+			}
+		}
+		nodes := make([]*node, len(acc))
+		for i := range nodes {
+			nodes[i] = newNode()
+		}
+		end = newNode()
+		for i, row := range trans {
+			if !live[i] {
+				continue
+			}
+			for j, k := range row {
+				if live[k] {
+					newLetterEdge(nodes[i], nodes[k], ls[j])
+				}
+			}
+			if acc[i] {
+				newNilEdge(nodes[i], end)
+			}
+		}
+		return nodes[0], end
+	}
+	// Under -setops, the complement ~r matches every string that r does not. It
+	// binds more tightly than concatenation, and more loosely than closures.
+	// Otherwise ~ is a literal, as it always was before the option.
+	var pnot func() (start, end *node)
+	pnot = func() (start, end *node) {
+		if !setOps || pos == len(s) || '~' != s[pos] {
+			return pclosure()
+		}
+		pos++
+		start, end = pnot()
+		ls := letters()
+		acc, trans := subDFA(start, end, ls)
+		for i := range acc {
+			acc[i] = !acc[i]
+		}
+		return fromDFA(acc, trans, ls)
+	}
 	pcat := func() (start, end *node) {
 		for {
-			nstart, nend := pclosure()
+			nstart, nend := pnot()
 			if start == nil {
 				start, end = nstart, nend
 			} else if nstart != nend {
@@ -466,16 +2637,52 @@ func gen(out *bufio.Writer, x *rule) {
 				return
 			}
 		}
-		panic("unreachable")
 	}
-	pre = func() (start, end *node) {
+	// Under -setops, the intersection r&s matches the strings that both r and s
+	// match. It binds more loosely than concatenation, and more tightly than
+	// alternation.
+	pand := func() (start, end *node) {
 		start, end = pcat()
+		for setOps && pos < len(s) && '&' == s[pos] {
+			pos++
+			nstart, nend := pcat()
+			ls := letters()
+			acc1, trans1 := subDFA(start, end, ls)
+			acc2, trans2 := subDFA(nstart, nend, ls)
+			// The product of the two DFAs.
+			var acc []bool
+			var trans [][]int
+			tab := make(map[[2]int]int)
+			var pairs [][2]int
+			get := func(p [2]int) int {
+				if i, ok := tab[p]; ok {
+					return i
+				}
+				tab[p] = len(pairs)
+				pairs = append(pairs, p)
+				acc = append(acc, acc1[p[0]] && acc2[p[1]])
+				return len(pairs) - 1
+			}
+			get([2]int{0, 0})
+			for i := 0; i < len(pairs); i++ {
+				row := make([]int, len(ls))
+				for j := range ls {
+					row[j] = get([2]int{trans1[pairs[i][0]][j], trans2[pairs[i][1]][j]})
+				}
+				trans = append(trans, row)
+			}
+			start, end = fromDFA(acc, trans, ls)
+		}
+		return
+	}
+	pre = func() (start, end *node) {
+		start, end = pand()
 		for pos < len(s) && s[pos] != ')' {
 			if s[pos] != '|' {
 				panic(ErrInternal)
 			}
 			pos++
-			nstart, nend := pcat()
+			nstart, nend := pand()
 			tmp := newNode()
 			newNilEdge(tmp, start)
 			newNilEdge(tmp, nstart)
@@ -487,237 +2694,187 @@ func gen(out *bufio.Writer, x *rule) {
 		}
 		return
 	}
-	start, end := pre()
-	end.accept = true
-
-	// Compute shortlist of nodes (reachable nodes), as we may have discarded
-	// nodes left over from parsing. Also, make short[0] the start node.
-	short := make([]*node, 0, n)
-	{
-		var visit func(*node)
-		mark := make([]bool, n)
-		newn := make([]int, n)
-		visit = func(u *node) {
-			mark[u.n] = true
-			newn[u.n] = len(short)
-			short = append(short, u)
-			for _, e := range u.e {
-				if !mark[e.dst.n] {
-					visit(e.dst)
-				}
+	// The NFA of the family has nil edges from its start node to the NFA of
+	// each rule, and each accepting node records its rule. We create the start
+	// node first so that it has index 0.
+	nfa := newNode()
+	cuts := make([]int, len(fam.kid))
+	within := make([][]rune, len(fam.kid))
+	for i, x := range fam.kid {
+		s, pos, fold = x.regex, 0, x.fold
+		start, end := pre()
+		within[i] = edgeLimits(start)
+		// For trailing context, we match the regex followed by the trailing
+		// context, and cut the match to size afterwards. Either part must have a
+		// fixed length so we know where to cut.
+		if x.trail != nil {
+			line, _ := strconv.Atoi(x.id)
+			hmin, hmax := lengthRange(start, end)
+			if hmin == 0 {
+				return nil, &lineError{line, ErrEmptyHead}
 			}
+			s, pos = x.trail, 0
+			tstart, tend := pre()
+			tmin, tmax := lengthRange(tstart, tend)
+			switch {
+			case hmin == hmax:
+				cuts[i] = hmin
+			case tmin == tmax:
+				cuts[i] = -tmin
+			default:
+				return nil, &lineError{line, ErrVariableTrail}
+			}
+			newNilEdge(end, tstart)
+			end = tend
 		}
-		visit(start)
-		for _, v := range short {
-			v.n = newn[v.n]
+		end.accept = true
+		end.rule = i
+		if active == nil || active[i] {
+			newNilEdge(nfa, start)
 		}
 	}
-	n = len(short)
-
+	name := fam.id
+	if name == "" {
+		name = "root"
+	}
 	if nfadot != nil {
-		writeDotGraph(nfadot, start, "NFA_"+x.id)
+		writeDotGraph(nfadot, nfa, "NFA_"+name)
 	}
 
 	// NFA -> DFA
-	nilClose := func(st []bool) {
-		visited := make([]bool, n)
-		var do func(int)
-		do = func(i int) {
-                        visited[i] = true
-			v := short[i]
-			for _, e := range v.e {
-				if e.kind == kNil && !visited[e.dst.n] {
-					st[e.dst.n] = true
-					do(e.dst.n)
-				}
-			}
-		}
-		for i := 0; i < n; i++ {
-			if st[i] && !visited[i] {
-				do(i)
-			}
-		}
+	d := buildDFA(nfa, letters())
+	if !noMinimize {
+		d.minimize()
 	}
-	var todo []*node
-	tab := make(map[string]*node)
-	var buf []byte
-	dfacount := 0
-	{ // Construct the node of no return.
-		for i := 0; i < n; i++ {
-			buf = append(buf, '0')
-		}
-		tmp := new(node)
-		tmp.n = -1
-		tab[string(buf)] = tmp
+	if dfadot != nil {
+		writeDotGraph(dfadot, d.graph(), "DFA_"+name)
 	}
-	newDFANode := func(st []bool) (res *node, found bool) {
-		buf = nil
-		accept := false
-		for i, v := range st {
-			if v {
-				buf = append(buf, '1')
-				accept = accept || short[i].accept
-			} else {
-				buf = append(buf, '0')
-			}
-		}
-		res, found = tab[string(buf)]
-		if !found {
-			res = new(node)
-			res.n = dfacount
-			res.accept = accept
-			dfacount++
-			for i, v := range st {
-				if v {
-					res.set = append(res.set, i)
-				}
+
+	d.fam = fam
+	d.cut = cuts
+	d.within = complementLimits(nil)
+	d.active = active
+	for i, x := range fam.kid {
+		if len(x.kid) > 0 && d.isActive(i) {
+			if d.nest == nil {
+				d.nest = make([]*dfa, len(fam.kid))
 			}
-			tab[string(buf)] = res
+			var err error
+			if d.nest[i], err = compileFamily(x, nil); err != nil {
+				return nil, err
+			}
+			d.nest[i].within = within[i]
 		}
-		return res, found
 	}
+	return d, nil
+}
 
-	get := func(states []bool) *node {
-		nilClose(states)
-		node, old := newDFANode(states)
-		if !old {
-			todo = append(todo, node)
-		}
-		return node
-	}
-	getcb := func(v *node, cb func(*edge) bool) *node {
-		states := make([]bool, n)
-		for _, i := range v.set {
-			for _, e := range short[i].e {
-				if cb(e) {
-					states[e.dst.n] = true
-				}
+// A named regex from the definitions section.
+type definition struct {
+	regex    []rune
+	line     int
+	expanded []rune // The regex with its references expanded, once known.
+	busy     bool   // True while expanding, to detect cycles.
+}
+
+// hasDefinitions reports whether a spec begins with a section of definitions
+// and declarations of start conditions, ended by a line "%%". Each line of the
+// section must begin with a name, or with "%s" or "%x". Otherwise the spec
+// begins with its rules, whose delimiters may be any rune.
+func hasDefinitions(spec string) bool {
+	n := 0
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case "" == line:
+		case "%%" == line:
+			return n > 0
+		case len(line) > 2 && '%' == line[0] && ('s' == line[1] || 'x' == line[1]) &&
+			(' ' == line[2] || '\t' == line[2]):
+			n++
+		default:
+			if c, _ := utf8.DecodeRuneInString(line); !isNameStart(c) {
+				return false
 			}
+			n++
 		}
-		return get(states)
 	}
-	states := make([]bool, n)
-	// The DFA start state is the state representing the nil-closure of the start
-	// node in the NFA. Recall it has index 0.
-	states[0] = true
-	dfastart := get(states)
-	for len(todo) > 0 {
-		v := todo[len(todo)-1]
-		todo = todo[0 : len(todo)-1]
-		// Singles.
-		var runes []rune
-		for r, _ := range sing {
-			runes = append(runes, r)
-		}
-		sort.Sort(RuneSlice(runes))
-		for _, r := range runes {
-			newRuneEdge(v, getcb(v, func(e *edge) bool {
-				return e.kind == kRune && e.r == r ||
-					e.kind == kWild ||
-					e.kind == kClass && e.negate != inClass(r, e.lim)
-			}), r)
-		}
-		// Character ranges.
-		for j := 0; j < len(lim); j += 2 {
-			e := newClassEdge(v, getcb(v, func(e *edge) bool {
-				return e.kind == kWild ||
-					e.kind == kClass && e.negate != inClass(lim[j], e.lim)
-			}))
+	return false
+}
 
-			e.lim = append(e.lim, lim[j], lim[j+1])
-		}
-		// Wild.
-		newWildEdge(v, getcb(v, func(e *edge) bool {
-			return e.kind == kWild || (e.kind == kClass && e.negate)
-		}))
-		// ^ and $.
-		newStartEdge(v, getcb(v, func(e *edge) bool { return e.kind == kStart }))
-		newEndEdge(v, getcb(v, func(e *edge) bool { return e.kind == kEnd }))
-	}
-	n = dfacount
+func isNameStart(c rune) bool {
+	return '_' == c || unicode.IsLetter(c)
+}
 
-	if dfadot != nil {
-		writeDotGraph(dfadot, dfastart, "DFA_"+x.id)
-	}
-	// DFA -> Go
-	sorted := make([]*node, n)
-	for _, v := range tab {
-		if -1 != v.n {
-			sorted[v.n] = v
-		}
-	}
+func isNameRune(c rune) bool {
+	return isNameStart(c) || unicode.IsDigit(c)
+}
 
-	fmt.Fprintf(out, "\n// %v\n", string(x.regex))
-	for i, v := range sorted {
-		if i == 0 {
-			out.WriteString("{[]bool{")
-		} else {
-			out.WriteString(", ")
-		}
-		if v.accept {
-			out.WriteString("true")
-		} else {
-			out.WriteString("false")
-		}
-	}
-	out.WriteString("}, []func(rune) int{  // Transitions\n")
-	for _, v := range sorted {
-		out.WriteString("func(r rune) int {\n")
-		var runeCases, classCases string
-		var wildDest int
-		for _, e := range v.e {
-			m := e.dst.n
-			switch e.kind {
-			case kRune:
-				runeCases += fmt.Sprintf("\t\tcase %d: return %d\n", e.r, m)
-			case kClass:
-				classCases += fmt.Sprintf("\t\tcase %d <= r && r <= %d: return %d\n",
-					e.lim[0], e.lim[1], m)
-			case kWild:
-				wildDest = m
+// Replaces each reference such as {DIGIT} in a regex with the corresponding
+// definition in parentheses. Errors within definitions carry their lines.
+func expandDefs(regex []rune, defs map[string]*definition) ([]rune, error) {
+	var res []rune
+	inClass := false
+	for i := 0; i < len(regex); i++ {
+		c := regex[i]
+		switch {
+		case '\\' == c:
+			res = append(res, c)
+			if i+1 == len(regex) {
+				continue
 			}
-		}
-		if runeCases != "" {
-			out.WriteString("\tswitch(r) {\n" + runeCases + "\t}\n")
-		}
-		if classCases != "" {
-			out.WriteString("\tswitch {\n" + classCases + "\t}\n")
-		}
-		fmt.Fprintf(out, "\treturn %v\n},\n", wildDest)
-	}
-	out.WriteString("}, []int{  /* Start-of-input transitions */ ")
-	for _, v := range sorted {
-		s := " -1,"
-		for _, e := range v.e {
-			if e.kind == kStart {
-				s = fmt.Sprintf(" %d,", e.dst.n)
-				break
+			i++
+			res = append(res, regex[i])
+			// Braces after \p, \P, \x and \e are part of the escape.
+			if strings.IndexRune("pPxe", regex[i]) != -1 &&
+				i+1 < len(regex) && '{' == regex[i+1] {
+				for i+1 < len(regex) && '}' != regex[i] {
+					i++
+					res = append(res, regex[i])
+				}
 			}
-		}
-		out.WriteString(s)
-	}
-	out.WriteString("}, []int{  /* End-of-input transitions */ ")
-	for _, v := range sorted {
-		s := " -1,"
-		for _, e := range v.e {
-			if e.kind == kEnd {
-				s = fmt.Sprintf(" %d,", e.dst.n)
+			continue
+		case inClass:
+			inClass = ']' != c
+		case '[' == c:
+			inClass = true
+		case '{' == c && i+1 < len(regex) && isNameStart(regex[i+1]):
+			j := i + 1
+			for j < len(regex) && isNameRune(regex[j]) {
+				j++
+			}
+			if j == len(regex) || '}' != regex[j] {
 				break
 			}
+			name := string(regex[i+1 : j])
+			d := defs[name]
+			if d == nil {
+				return nil, ErrUndefinedName
+			}
+			if d.expanded == nil {
+				if d.busy {
+					return nil, ErrDefinitionCycle
+				}
+				d.busy = true
+				x, err := expandDefs(d.regex, defs)
+				d.busy = false
+				if err != nil {
+					if _, ok := err.(*lineError); !ok {
+						err = &lineError{d.line, err}
+					}
+					return nil, err
+				}
+				d.expanded = x
+			}
+			res = append(res, '(')
+			res = append(res, d.expanded...)
+			res = append(res, ')')
+			i = j
+			continue
 		}
-		out.WriteString(s)
-	}
-	out.WriteString("},")
-	if len(x.kid) == 0 {
-		out.WriteString("nil")
-	} else {
-		out.WriteString("[]dfa{")
-		for _, kid := range x.kid {
-			gen(out, kid)
-		}
-		out.WriteString("}")
+		res = append(res, c)
 	}
-	out.WriteString("},\n")
+	return res, nil
 }
 
 func writeFamily(out *bufio.Writer, node *rule, lvl int) {
@@ -767,216 +2924,780 @@ func writeFamily(out *bufio.Writer, node *rule, lvl int) {
 	out.WriteString(node.endCode + "\n")
 }
 
-var lexertext = `import ("bufio";"io";"strings")
+var lexertext = `
+// Each byte of input that is not valid UTF-8 is kept as a rune past the last
+// code point, so that the text of a frame holds it as it was. If invalidBytes
+// is set, as by nex's -invalid option, rules read it as such, so that they can
+// tell it apart from U+FFFD. Otherwise they read it as U+FFFD, as does Text.
+const invalidByte = utf8.MaxRune + 1
+
+// A frame is a match of rule i with text s, a rune of unmatched text if i is
+// -2, or the end of input if i is -1. Lines and columns count from 0, columns
+// and offsets count runes and bytes, and all are absolute in the input. Text
+// from Unput is not in the input, and takes up no room there.
 type frame struct {
   i int
   s string
-  line, column int
+  line, column, offset int  // The start of the text.
+  endLine, endColumn int  // Just past the text.
+  unput int  // The number of runes at the start of the text that came from Unput.
+}
+
+// input returns the part of the text of a frame that lies in the input.
+func (f frame) input() string {
+  s := f.s
+  for n := 0; n < f.unput && s != ""; n++ {
+    _, size := utf8.DecodeRuneInString(s)
+    s = s[size:]
+  }
+  return s
+}
+
+// text returns the text of a frame as rules read it.
+func (f frame) text() string {
+  if invalidBytes || utf8.ValidString(f.s) {
+    return f.s
+  }
+  var b strings.Builder
+  for _, r := range f.s {
+    b.WriteRune(r)
+  }
+  return b.String()
+}
+
+// index returns the offset in the text of a frame of the byte at offset n in
+// the text as rules read it.
+func (f frame) index(n int) int {
+  if invalidBytes || utf8.ValidString(f.s) {
+    return n
+  }
+  for i, r := range f.s {
+    if n <= 0 {
+      return i
+    }
+    n -= utf8.RuneLen(r)
+  }
+  return len(f.s)
+}
+
+// Either kind of scanner tracks the position of the rest of its input.
+
+// advance moves the position of a scanner past the given text, less the runes
+// at its start that came from Unput, and returns the number of those runes.
+func (s *scanner) advance(text string) int {
+  n := 0
+  for ; n < s.unput && text != ""; n++ {
+    _, size := utf8.DecodeRuneInString(text)
+    text = text[size:]
+  }
+  s.unput -= n
+  for _, r := range text {
+    if r == '\n' {
+      s.line++
+      s.column = 0
+    } else {
+      s.column++
+    }
+  }
+  s.offset += len(text)
+  return n
+}
+
+// take returns a frame for the given text at the position of a scanner, which
+// it then moves past the text.
+func (s *scanner) take(i int, text string) frame {
+  f := frame{i: i, s: text, line: s.line, column: s.column, offset: s.offset}
+  f.unput = s.advance(text)
+  f.endLine, f.endColumn = s.line, s.column
+  return f
+}
+
+// The treatment of input that no rule matches in a family of rules. A nested
+// family starts with that of its parent.
+type fallback struct {
+  onUnmatched func(text string, line, column int)  // Receives such input, if set.
+  out io.Writer  // Otherwise, such input is copied here, if set, as is text passed to Echo.
+}
+// A LexError is an error that the lexer met at the given line and column,
+// which count from 0 like those of Line and Column.
+type LexError struct {
+  Line, Column int
+  Err error
+}
+
+func (e *LexError) Error() string {
+  return "line " + yystrconv.Itoa(e.Line + 1) + ", column " + yystrconv.Itoa(e.Column + 1) + ": " + e.Err.Error()
 }
+
+func (e *LexError) Unwrap() error {
+  return e.Err
+}
+
 type Lexer struct {
-  // The lexer runs in its own goroutine, and communicates via channel 'ch'.
-  ch chan frame
-  ch_stop chan bool
+  // The lexer runs on the caller's goroutine. Each level of nesting has its
+  // own scanner, and 'scan' holds the scanners currently in progress.
+  scan []*scanner
+  stopped bool
   // We record the level of nesting because the action could return, and a
   // subsequent call expects to pick up where it left off. In other words,
   // we're simulating a coroutine.
   // TODO: Support a channel-based variant that compatible with Go's yacc.
   stack []frame
   stale bool
+  err error  // The first error met, if any.
+  contextState  // Set by NewLexerContext, under the -context option.
+  fileState  // Set by NewLexerFile, under the -fileset option.
+
+  // The active start condition, and those saved by PushState.
+  cond int
+  condStack []int
 
   // The 'l' and 'c' fields were added for
   // https://github.com/wagerlabs/docker/blob/65694e801a7b80930961d70c69cba9f2465459be/buildfile.nex
   // Since then, I introduced the built-in Line() and Column() functions.
   l, c int
 
-  parseResult interface{}
+  parseResult interface{}
+
+  // The following line makes it easy for scripts to insert fields in the
+  // generated code.
+  // [NEX_END_OF_LEXER_STRUCT]
+}
+
+// NewLexerWithInit creates a new Lexer object, runs the given callback on it,
+// then returns it.
+func NewLexerWithInit(in io.Reader, initFun func(*Lexer)) *Lexer {
+  yylex := new(Lexer)
+  yylex.scan = []*scanner{newScanner(bufio.NewReader(in), dfas, 0, 0, 0)}
+  if initFun != nil {
+    initFun(yylex)
+  }
+  return yylex
+}
+`
+
+// The runtime for DFAs that run over runes.
+var runeScannerText = `// A scanner finds successive matches of a family of rules in its input.
+type scanner struct {
+  in *bufio.Reader
+  fam *family
+  buf []rune
+  line, column, offset int
+  unput int  // The number of runes at the start of the input that came from Unput.
+  started, atEOF, done bool
+  eof bool  // True once the reader is exhausted.
+  err error  // The error that ended the input, if any.
+  fb fallback
+}
+
+func newScanner(in *bufio.Reader, fam *family, line, column, offset int) *scanner {
+  return &scanner{in: in, fam: fam, line: line, column: column, offset: offset}
+}
+
+// NewLexerBytes creates a new Lexer object that scans the given bytes.
+func NewLexerBytes(b []byte) *Lexer {
+  return NewLexer(strings.NewReader(string(b)))
+}
+
+// runeText returns the input that the given runes were read from.
+func runeText(rs []rune) string {
+  var b strings.Builder
+  for _, r := range rs {
+    if r >= invalidByte {
+      b.WriteByte(byte(r - invalidByte))
+    } else {
+      b.WriteRune(r)
+    }
+  }
+  return b.String()
+}
+
+// textRunes returns the runes that the given input reads as.
+func textRunes(text string) []rune {
+  rs := make([]rune, 0, len(text))
+  for len(text) > 0 {
+    r, size := utf8.DecodeRuneInString(text)
+    if r == utf8.RuneError && size == 1 {
+      r = invalidByte + rune(text[0])
+    }
+    rs = append(rs, r)
+    text = text[size:]
+  }
+  return rs
+}
+
+// unread returns text to the input, to be scanned before the rest of it. Text
+// from Unput goes first; other text goes after any from Unput not yet scanned.
+func (s *scanner) unread(text string, unput bool) {
+  if text != "" {
+    k := 0
+    if !unput {
+      k = s.unput
+    }
+    runes := textRunes(text)
+    s.buf = append(append(append([]rune(nil), s.buf[:k]...), runes...), s.buf[k:]...)
+    if unput {
+      s.unput += len(runes)
+    }
+    s.atEOF, s.done = false, false
+  }
+}
+
+// fail ends the scan after an error reading the input, without matching what
+// was read. The frame it returns holds the position of the error.
+func (s *scanner) fail() frame {
+  s.advance(runeText(s.buf))
+  s.buf, s.done = nil, true
+  return s.take(-1, "")
+}
+
+// next returns the next match, a frame with index -2 for a rune that no rule
+// matches, or a frame with index -1 at the end of input or after an error.
+func (s *scanner) next() frame {
+  fam := s.fam
+  // Rule and length of highest-precedence match so far.
+  matchi, matchn := 0, -1
+  n := 0
+  st := 0
+  if !s.started {
+    s.started = true
+    // At the start of input, the DFA may follow ^ transitions.
+    st = fam.start
+    if -1 != fam.startAcc {
+      matchi, matchn = fam.startAcc, 0
+    }
+  }
+  for !s.done {
+    if n == len(s.buf) && !s.atEOF {
+      var r rune
+      err := io.EOF
+      if !s.eof {
+        var size int
+        r, size, err = s.in.ReadRune()
+        if r == utf8.RuneError && size == 1 {
+          // Keep the invalid byte rather than U+FFFD.
+          s.in.UnreadRune()
+          b, _ := s.in.ReadByte()
+          r = invalidByte + rune(b)
+        }
+      }
+      switch err {
+      case io.EOF: s.atEOF, s.eof = true, true
+      case nil:    s.buf = append(s.buf, r)
+      default:
+        s.err = err
+        return s.fail()
+      }
+    }
+    if !s.atEOF {
+      r := s.buf[n]
+      n++
+      if r >= invalidByte && !invalidBytes {
+        r = utf8.RuneError
+      }
+      st = fam.step(st, r)
+      if -1 != st {
+        // Each state accepts the first rule it matches, and a longer match
+        // always has higher precedence.
+        if i := fam.acc[st]; -1 != i {
+          matchi, matchn = i, n
+        }
+        continue
+      }
+    } else if i := fam.eof[st]; -1 != i && (matchn < n || matchi > i) {
+      // Handle $.
+      matchi, matchn = i, n
+    }
+    // DFA stuck. Return last match if it exists, otherwise skip a rune.
+    if matchn == -1 {
+      if len(s.buf) == 0 {  // This can only happen at the end of input.
+        break
+      }
+      f := s.take(-2, runeText(s.buf[:1]))
+      s.buf = s.buf[1:]
+      // Whatever follows has yet to reach the end of input.
+      s.atEOF = false
+      return f
+    }
+    // Give back any trailing context. If we looked as far as the end of input,
+    // we must scan whatever follows the match again.
+    cut := fam.cut[matchi]
+    if cut > 0 {
+      matchn = cut
+    } else {
+      matchn += cut
+    }
+    f := s.take(matchi, runeText(s.buf[:matchn]))
+    s.buf = s.buf[matchn:]
+    if s.atEOF {
+      if len(s.buf) > 0 {
+        s.atEOF = false
+      } else {
+        s.done = true
+      }
+    }
+    return f
+  }
+  s.done = true
+  return s.take(-1, "")
+}
+`
+
+// The runtime for DFAs whose transitions are functions.
+var closureText = `
+// A family is a DFA that matches a family of rules.
+type family struct {
+  acc []int  // Rule accepted by each state, or -1.
+  eof []int  // Rule accepted by each state at the end of input, or -1.
+  f []func(rune) int  // Transitions.
+  start int  // State at the start of input.
+  startAcc int  // Rule accepted at the start of input, or -1.
+  // For rules with trailing context, a positive cut is the number of runes to
+  // keep from a match, and a negative cut is the number to give back.
+  cut []int
+  nest []*family  // Nested family of each rule, or nil.
+}
+
+func (fam *family) step(st int, r rune) int {
+  return fam.f[st](r)
+}
+`
+
+// The runtime for DFAs whose transitions are compressed tables over rune
+// classes.
+var tableText = `
+// A family is a DFA that matches a family of rules.
+type family struct {
+  acc []int  // Rule accepted by each state, or -1.
+  eof []int  // Rule accepted by each state at the end of input, or -1.
+  // Transitions on rune classes, compressed by row displacement. From state
+  // st, class c leads to next[base[st]+c] if check[base[st]+c] is st, and to
+  // def[st] otherwise.
+  base, def, next, check []int
+  start int  // State at the start of input.
+  startAcc int  // Rule accepted at the start of input, or -1.
+  // For rules with trailing context, a positive cut is the number of runes to
+  // keep from a match, and a negative cut is the number to give back.
+  cut []int
+  nest []*family  // Nested family of each rule, or nil.
+}
+
+func (fam *family) step(st int, r rune) int {
+  i := fam.base[st] + runeClass(r)
+  if fam.check[i] == st {
+    return fam.next[i]
+  }
+  return fam.def[st]
+}
+
+// runeClass returns the class of a rune. Runes in the same class behave alike
+// in every DFA.
+func runeClass(r rune) int {
+  if 0 <= r && r < 256 {
+    return runeClassLatin1[r]
+  }
+  // Find the last range starting at or before r.
+  lo, hi := 0, len(runeClassLo)
+  for hi - lo > 1 {
+    m := (lo + hi) / 2
+    if runeClassLo[m] <= r {
+      lo = m
+    } else {
+      hi = m
+    }
+  }
+  return runeClassOf[lo]
+}
+`
 
-  // The following line makes it easy for scripts to insert fields in the
-  // generated code.
-  // [NEX_END_OF_LEXER_STRUCT]
+// The runtime for DFAs whose states are labelled blocks of code that run over
+// bytes.
+var gotoText = `// A scanner finds successive matches of a family of rules in its input.
+type scanner struct {
+  in *bufio.Reader
+  fam *family
+  // Input from the start of the next match. The text of each match is a slice
+  // of it, so reading more input builds a new string rather than overwriting.
+  buf string
+  chunk []byte  // Space to read more input into.
+  line, column, offset int
+  unput int  // The number of runes at the start of the input that came from Unput.
+  started, atEOF, done bool
+  eof bool  // True once the reader is exhausted.
+  err error  // The error that ended the input, if any.
+  fb fallback
 }
 
-// NewLexerWithInit creates a new Lexer object, runs the given callback on it,
-// then returns it.
-func NewLexerWithInit(in io.Reader, initFun func(*Lexer)) *Lexer {
+func newScanner(in *bufio.Reader, fam *family, line, column, offset int) *scanner {
+  return &scanner{in: in, fam: fam, line: line, column: column, offset: offset}
+}
+
+// NewLexerBytes creates a new Lexer object that scans the given bytes. It
+// copies them once, and the text of each token is a slice of the copy.
+func NewLexerBytes(b []byte) *Lexer {
   yylex := new(Lexer)
-  if initFun != nil {
-    initFun(yylex)
+  yylex.scan = []*scanner{&scanner{fam: dfas, buf: string(b), eof: true}}
+  return yylex
+}
+
+// more reports whether a whole rune follows offset p of the buffer, reading
+// more input if needed. Otherwise we have reached the end of input.
+func (s *scanner) more(p int) bool {
+  for !s.eof && !utf8.FullRuneInString(s.buf[p:]) {
+    // Read at least as much as the buffer holds, so that a long match takes
+    // time linear in its length.
+    if len(s.chunk) <= len(s.buf) {
+      s.chunk = make([]byte, 2*len(s.buf) + 4096)
+    }
+    n, err := s.in.Read(s.chunk)
+    s.buf += string(s.chunk[:n])
+    switch err {
+    case io.EOF: s.eof = true
+    case nil:
+    default:
+      // The scan ends once the match is abandoned.
+      s.err, s.eof = err, true
+    }
   }
-  yylex.ch = make(chan frame)
-  yylex.ch_stop = make(chan bool, 1)
-  var scan func(in *bufio.Reader, ch chan frame, ch_stop chan bool, family []dfa, line, column int) 
-  scan = func(in *bufio.Reader, ch chan frame, ch_stop chan bool, family []dfa, line, column int) {
-    // Index of DFA and length of highest-precedence match so far.
-    matchi, matchn := 0, -1
-    var buf []rune
-    n := 0
-    checkAccept := func(i int, st int) bool {
-      // Higher precedence match? DFAs are run in parallel, so matchn is at most len(buf), hence we may omit the length equality check.
-      if family[i].acc[st] && (matchn < n || matchi > i) {
-        matchi, matchn = i, n
-        return true
-      }
-      return false
+  if p == len(s.buf) {
+    s.atEOF = true
+    return false
+  }
+  return true
+}
+
+// unread returns text to the input, to be scanned before the rest of it. Text
+// from Unput goes first; other text goes after any from Unput not yet scanned.
+func (s *scanner) unread(text string, unput bool) {
+  if text != "" {
+    k := 0
+    for n := 0; n < s.unput && !unput; n++ {
+      _, size := utf8.DecodeRuneInString(s.buf[k:])
+      k += size
+    }
+    s.buf = s.buf[:k] + text + s.buf[k:]
+    if unput {
+      s.unput += utf8.RuneCountInString(text)
+    }
+    s.atEOF, s.done = false, false
+  }
+}
+
+// fail ends the scan after an error reading the input, without matching what
+// was read. The frame it returns holds the position of the error.
+func (s *scanner) fail() frame {
+  s.advance(s.buf)
+  s.buf, s.done = "", true
+  return s.take(-1, "")
+}
+
+// next returns the next match, a frame with index -2 for a rune that no rule
+// matches, or a frame with index -1 at the end of input or after an error.
+func (s *scanner) next() frame {
+  for !s.done {
+    matchi, matchn := s.fam.match(s)
+    if s.err != nil {
+      return s.fail()
     }
-    var state [][2]int
-    for i := 0; i < len(family); i++ {
-      mark := make([]bool, len(family[i].startf))
-      // Every DFA starts at state 0.
-      st := 0
-      for {
-        state = append(state, [2]int{i, st})
-        mark[st] = true
-        // As we're at the start of input, follow all ^ transitions and append to our list of start states.
-        st = family[i].startf[st]
-        if -1 == st || mark[st] { break }
-        // We only check for a match after at least one transition.
-        checkAccept(i, st)
+    // No match. Skip a rune, which may not be in the buffer whole: the match
+    // can fail on its first byte.
+    if matchn == -1 {
+      if !s.more(0) {  // This can only happen at the end of input.
+        break
       }
+      if s.err != nil {
+        return s.fail()
+      }
+      _, n := utf8.DecodeRuneInString(s.buf)
+      f := s.take(-2, s.buf[:n])
+      s.buf = s.buf[n:]
+      // Whatever follows has yet to reach the end of input.
+      s.atEOF = false
+      return f
     }
-    atEOF := false
-    stopped := false
-    for {
-      if n == len(buf) && !atEOF {
-        r,_,err := in.ReadRune()
-        switch err {
-        case io.EOF: atEOF = true
-        case nil:    buf = append(buf, r)
-        default:     panic(err)
-        }
+    // Give back any trailing context. If we looked as far as the end of input,
+    // we must scan whatever follows the match again.
+    cut := s.fam.cut[matchi]
+    if cut > 0 {
+      matchn = 0
+      for i := 0; i < cut; i++ {
+        _, n := utf8.DecodeRuneInString(s.buf[matchn:])
+        matchn += n
       }
-      if !atEOF {
-        r := buf[n]
-        n++
-        var nextState [][2]int
-        for _, x := range state {
-          x[1] = family[x[0]].f[x[1]](r)
-          if -1 == x[1] { continue }
-          nextState = append(nextState, x)
-          checkAccept(x[0], x[1])
-        }
-        state = nextState
+    }
+    for i := 0; i > cut; i-- {
+      _, n := utf8.DecodeLastRuneInString(s.buf[:matchn])
+      matchn -= n
+    }
+    f := s.take(matchi, s.buf[:matchn])
+    s.buf = s.buf[matchn:]
+    if s.atEOF {
+      if len(s.buf) > 0 {
+        s.atEOF = false
       } else {
-dollar:  // Handle $.
-        for _, x := range state {
-          mark := make([]bool, len(family[x[0]].endf))
-          for {
-            mark[x[1]] = true
-            x[1] = family[x[0]].endf[x[1]]
-            if -1 == x[1] || mark[x[1]] { break }
-            if checkAccept(x[0], x[1]) {
-              // Unlike before, we can break off the search. Now that we're at the end, there's no need to maintain the state of each DFA.
-              break dollar
-            }
-          }
-        }
-        state = nil
-      }
-
-      if state == nil {
-        lcUpdate := func(r rune) {
-          if r == '\n' {
-            line++
-            column = 0
-          } else {
-            column++
-          }
-        }
-        // All DFAs stuck. Return last match if it exists, otherwise advance by one rune and restart all DFAs.
-        if matchn == -1 {
-          if len(buf) == 0 {  // This can only happen at the end of input.
-            break
-          }
-          lcUpdate(buf[0])
-          buf = buf[1:]
-        } else {
-          text := string(buf[:matchn])
-          buf = buf[matchn:]
-          matchn = -1
-          select {
-            case ch <- frame{matchi, text, line, column}: {
-            }
-            case stopped = <- ch_stop: {
-            }
-          }
-          if stopped {
-            break
-          }
-          if len(family[matchi].nest) > 0 {
-            scan(bufio.NewReader(strings.NewReader(text)), ch, ch_stop, family[matchi].nest, line, column)
-          }
-          if atEOF {
-            break
-          }
-          for _, r := range text {
-            lcUpdate(r)
-          }
-        }
-        n = 0
-        for i := 0; i < len(family); i++ {
-          state = append(state, [2]int{i, 0})
-        }
+        s.done = true
       }
     }
-    ch <- frame{-1, "", line, column}
+    return f
   }
-  go scan(bufio.NewReader(in), yylex.ch, yylex.ch_stop, dfas, 0, 0)
-  return yylex
+  s.done = true
+  return s.take(-1, "")
 }
 
-type dfa struct {
-  acc []bool  // Accepting states.
-  f []func(rune) int  // Transitions.
-  startf, endf []int  // Transitions at start and end of input.
-  nest []dfa
+// A family is a DFA that matches a family of rules.
+type family struct {
+  // match returns the rule and length in bytes of the longest match at the
+  // start of the buffer, where the length is -1 if there is none.
+  match func(s *scanner) (int, int)
+  // For rules with trailing context, a positive cut is the number of runes to
+  // keep from a match, and a negative cut is the number to give back.
+  cut []int
+  nest []*family  // Nested family of each rule, or nil.
 }
+`
+
+// The runtime for start conditions, if the rules declare any.
+var conditionsText = `
+// Begin makes the given start condition active, so that the following tokens
+// only match the rules active in it. Called from the action of a nested rule,
+// it has no effect until the nested family ends, since nested rules follow the
+// condition of the rule they are nested in.
+func (yylex *Lexer) Begin(cond int) {
+  yylex.cond = cond
+  yylex.scan[0].fam = conditions[cond]
+}
+
+// State returns the active start condition.
+func (yylex *Lexer) State() int {
+  return yylex.cond
+}
+
+// PushState saves the active start condition on a stack, then begins the
+// given one.
+func (yylex *Lexer) PushState(cond int) {
+  yylex.condStack = append(yylex.condStack, yylex.cond)
+  yylex.Begin(cond)
+}
+
+// PopState begins the start condition last saved by PushState, removing it
+// from the stack. If the stack is empty, it begins INITIAL.
+func (yylex *Lexer) PopState() {
+  n := len(yylex.condStack) - 1
+  if n < 0 {
+    yylex.Begin(INITIAL)
+    return
+  }
+  yylex.Begin(yylex.condStack[n])
+  yylex.condStack = yylex.condStack[:n]
+}
+`
+
+// By default, the runtime copies input that no rule matches to the output, if
+// any, as flex does, and otherwise discards it.
+var unmatchedText = `
+// unmatched passes input that no rule matches to the OnUnmatched function, or
+// else copies it to the output, if any.
+func (yylex *Lexer) unmatched(fb fallback, f frame) {
+  switch {
+  case fb.onUnmatched != nil:
+    fb.onUnmatched(f.text(), f.line, f.column)
+  case fb.out != nil:
+    io.WriteString(fb.out, f.text())
+  }
+}
+`
 
-var dfas = []dfa{`
+// With the -nodefault option, input that no rule matches is an error unless
+// an OnUnmatched function takes it.
+var noDefaultText = `
+// unmatched passes input that no rule matches to the OnUnmatched function, or
+// else ends lexing with an error, since there is no default rule.
+func (yylex *Lexer) unmatched(fb fallback, f frame) {
+  if fb.onUnmatched == nil {
+    yylex.fail(f.line, f.column, yyerrors.New("input " + yystrconv.Quote(f.text()) + " is not covered by any rule"))
+    yylex.Stop()
+    return
+  }
+  fb.onUnmatched(f.text(), f.line, f.column)
+}
+`
 
-var lexeroutro = `}
+var lexeroutro = `
 
 func NewLexer(in io.Reader) *Lexer {
   return NewLexerWithInit(in, nil)
 }
 
+// Stop ends scanning. Subsequent calls to Lex find the end of input.
 func (yyLex *Lexer) Stop() {
-  yyLex.ch_stop <- true
+  yyLex.stopped = true
+}
+
+// Err returns the first error that the lexer met, if any, as a *LexError. An
+// error reading the input ends lexing, as does input no rule covers under
+// -nodefault, so that Lex finds the end of input.
+func (yylex *Lexer) Err() error {
+  return yylex.err
+}
+
+// fail records an error at the given position, unless an earlier one stands.
+func (yylex *Lexer) fail(line, column int, err error) {
+  if yylex.err == nil {
+    yylex.err = &LexError{line, column, err}
+  }
 }
 
 // Text returns the matched text.
 func (yylex *Lexer) Text() string {
-  return yylex.stack[len(yylex.stack) - 1].s
+  return yylex.stack[len(yylex.stack) - 1].text()
+}
+
+// top returns the frame of the current match. Outside any match, as before
+// the first call to Lex or once it has returned 0, it returns an empty frame
+// at the position of the rest of the input, so that errors reported there,
+// such as yacc's "unexpected $end", carry the position of the end of input.
+func (yylex *Lexer) top() frame {
+  if len(yylex.stack) == 0 {
+    s := yylex.scan[0]
+    return frame{line: s.line, column: s.column, offset: s.offset, endLine: s.line, endColumn: s.column}
+  }
+  return yylex.stack[len(yylex.stack) - 1]
 }
 
 // Line returns the current line number.
 // The first line is 0.
 func (yylex *Lexer) Line() int {
-  if len(yylex.stack) == 0 {
-    return 0
-  }
-  return yylex.stack[len(yylex.stack) - 1].line
+  return yylex.top().line
 }
 
 // Column returns the current column number.
 // The first column is 0.
 func (yylex *Lexer) Column() int {
-  if len(yylex.stack) == 0 {
-    return 0
+  return yylex.top().column
+}
+
+// Offset returns the offset in bytes of the matched text in the input.
+func (yylex *Lexer) Offset() int {
+  return yylex.top().offset
+}
+
+// EndOffset returns the offset in bytes just past the matched text. Text from
+// Unput takes up no room, so that the bytes from Offset to EndOffset are those
+// of the input in the matched text.
+func (yylex *Lexer) EndOffset() int {
+  f := yylex.top()
+  return f.offset + len(f.input())
+}
+
+// EndLine returns the line number just past the matched text, which differs
+// from Line only if the text holds a newline.
+func (yylex *Lexer) EndLine() int {
+  return yylex.top().endLine
+}
+
+// EndColumn returns the column number just past the matched text.
+func (yylex *Lexer) EndColumn() int {
+  return yylex.top().endColumn
+}
+
+// OnUnmatched sets a function to receive each rune of input that no rule
+// matches, along with its line and column, in place of the default. Like
+// SetOutput, it applies to the family of rules in progress, which in the code
+// at the start of a nested family is the nested family, and to the families
+// nested within it.
+func (yylex *Lexer) OnUnmatched(f func(text string, line, column int)) {
+  yylex.scan[len(yylex.scan) - 1].fb.onUnmatched = f
+}
+
+// SetOutput sets the writer that Echo copies text to. Unless an OnUnmatched
+// function takes it, input that no rule matches is copied there too.
+func (yylex *Lexer) SetOutput(w io.Writer) {
+  yylex.scan[len(yylex.scan) - 1].fb.out = w
+}
+
+// Echo copies the matched text to the output, if any.
+func (yylex *Lexer) Echo() {
+  if out := yylex.scan[len(yylex.scan) - 1].fb.out; out != nil {
+    io.WriteString(out, yylex.Text())
+  }
+}
+
+// Less keeps the first n bytes of the matched text, and returns the rest to the
+// input to be scanned again. Line and column numbers follow the text kept.
+func (yylex *Lexer) Less(n int) {
+  lvl := len(yylex.stack) - 1
+  f, s := &yylex.stack[lvl], yylex.scan[lvl]
+  n = f.index(n)
+  // The text returned goes after any text from Unput still to be scanned, and
+  // what of it came from Unput itself joins that text.
+  s.unread(f.s[n:], false)
+  s.line, s.column, s.offset = f.line, f.column, f.offset
+  unput := s.unput
+  s.unput = f.unput
+  *f = s.take(f.i, f.s[:n])
+  s.unput += unput
+  // In the code at the start of a nested family, its scanner has yet to read
+  // the matched text.
+  if len(yylex.scan) > len(yylex.stack) {
+    yylex.scan[lvl + 1].in = bufio.NewReader(strings.NewReader(f.s))
+    yylex.scan[lvl + 1].unput = f.unput
+  }
+}
+
+// Unput returns the given text to the input, to be scanned right after the
+// matched text, as though it had followed it there. It takes up no room in
+// positions, which go on referring to the input: text matched from it starts
+// where the matched text ends, and so do matches that follow it.
+func (yylex *Lexer) Unput(text string) {
+  yylex.scan[len(yylex.stack) - 1].unread(text, true)
+}
+
+// pull returns the next match from the innermost scanner in progress. A match
+// of a rule with a nested family starts a scanner on the matched text, which
+// runs until it reports the end of its input.
+func (yylex *Lexer) pull() frame {
+  s := yylex.scan[len(yylex.scan) - 1]
+  var f frame
+  for {
+    yylex.checkContext(s)
+    if yylex.stopped {
+      return s.take(-1, "")
+    }
+    f = s.next()
+    yylex.addLines(f)
+    if f.i != -2 {
+      break
+    }
+    yylex.unmatched(s.fb, f)
+  }
+  if f.i == -1 && s.err != nil {
+    yylex.fail(f.line, f.column, s.err)
+  }
+  if f.i == -1 {
+    if len(yylex.scan) > 1 {
+      yylex.scan = yylex.scan[:len(yylex.scan) - 1]
+    }
+  } else if s.fam.nest != nil && s.fam.nest[f.i] != nil {
+    t := newScanner(bufio.NewReader(strings.NewReader(f.s)), s.fam.nest[f.i], f.line, f.column, f.offset)
+    t.fb = s.fb
+    t.unput = f.unput
+    yylex.scan = append(yylex.scan, t)
   }
-  return yylex.stack[len(yylex.stack) - 1].column
+  return f
 }
 
 func (yylex *Lexer) next(lvl int) int {
   if lvl == len(yylex.stack) {
-    l, c := 0, 0
+    var f frame
     if lvl > 0 {
-      l, c = yylex.stack[lvl - 1].line, yylex.stack[lvl - 1].column
+      p := yylex.stack[lvl - 1]
+      f = frame{line: p.line, column: p.column, offset: p.offset, endLine: p.line, endColumn: p.column}
     }
-    yylex.stack = append(yylex.stack, frame{0, "", l, c})
+    yylex.stack = append(yylex.stack, f)
   }
   if lvl == len(yylex.stack) - 1 {
     p := &yylex.stack[lvl]
-    *p = <-yylex.ch
+    *p = yylex.pull()
     yylex.stale = false
   } else {
     yylex.stale = true
@@ -988,11 +3709,209 @@ func (yylex *Lexer) pop() {
 }
 `
 
+// The runtime for the -context option.
+var contextText = `
+type contextState struct {
+  ctx yycontext.Context  // Scanning stops once this is done, if set.
+}
+
+// NewLexerContext creates a new Lexer object that stops scanning once the
+// context is done, even while waiting for input, whereupon Err returns an error
+// that wraps ctx.Err(), so that errors.Is(err, context.Canceled) holds after
+// cancellation.
+func NewLexerContext(ctx yycontext.Context, in io.Reader) *Lexer {
+  yylex := NewLexer(&ctxReader{ctx: ctx, in: in})
+  yylex.ctx = ctx
+  return yylex
+}
+
+// A ctxReader reads from another reader until the context is done. Unless the
+// context can never be done, one goroutine reads on its behalf, so that a read
+// still blocked when the context is done can be abandoned. If the reader has a
+// SetReadDeadline method, as network connections and pipes do, the blocked
+// read is then cut short, and the deadline cleared once it returns. Otherwise
+// the read lasts until the reader returns. The
+// goroutine ends at the end of input, or once the context is done and any read
+// in progress has returned.
+type ctxReader struct {
+  ctx yycontext.Context
+  in io.Reader
+  buf []byte  // Filled by the goroutine while a read is in progress.
+  rest []byte  // What remains of the last read.
+  err error  // The error that ended the last read, if any.
+  next chan struct{}  // Asks the goroutine for a read.
+  res chan ctxResult  // Receives the outcome of each read.
+}
+
+type ctxResult struct {
+  n int
+  err error
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+  if err := r.ctx.Err(); err != nil {
+    return 0, err
+  }
+  if r.ctx.Done() == nil {
+    return r.in.Read(p)
+  }
+  if len(r.rest) == 0 && r.err == nil {
+    if r.next == nil {
+      r.buf = make([]byte, len(p))
+      r.next, r.res = make(chan struct{}), make(chan ctxResult, 1)
+      go r.loop()
+    }
+    select {
+    case r.next <- struct{}{}:
+    case <-r.ctx.Done():
+      return 0, r.ctx.Err()
+    }
+    select {
+    case res := <-r.res:
+      r.rest, r.err = r.buf[:res.n], res.err
+    case <-r.ctx.Done():
+      // Once the deadline cuts the read short, clear it again, so that the
+      // reader is as it was for whoever reads from it next.
+      if d, ok := r.in.(interface{ SetReadDeadline(yytime.Time) error }); ok && d.SetReadDeadline(yytime.Now()) == nil {
+        <-r.res
+        d.SetReadDeadline(yytime.Time{})
+      }
+      return 0, r.ctx.Err()
+    }
+  }
+  n := copy(p, r.rest)
+  r.rest = r.rest[n:]
+  if n == 0 {
+    return 0, r.err
+  }
+  return n, nil
+}
+
+// loop reads into the buffer whenever asked, until a read fails or the context
+// is done.
+func (r *ctxReader) loop() {
+  for {
+    select {
+    case <-r.next:
+    case <-r.ctx.Done():
+      return
+    }
+    n, err := r.in.Read(r.buf)
+    r.res <- ctxResult{n, err}
+    if err != nil {
+      return
+    }
+  }
+}
+
+// checkContext stops scanning once the context, if any, is done, recording its
+// error at the position of the given scanner.
+func (yylex *Lexer) checkContext(s *scanner) {
+  if yylex.ctx != nil && !yylex.stopped {
+    if err := yylex.ctx.Err(); err != nil {
+      yylex.fail(s.line, s.column, err)
+      yylex.Stop()
+    }
+  }
+}
+`
+
+// Without the -context option, a lexer has no context.
+var noContextText = `
+type contextState struct{}
+
+func (yylex *Lexer) checkContext(s *scanner) {}
+`
+
+// The runtime for the -fileset option.
+var fileText = `
+type fileState struct {
+  file *yytoken.File  // The file that positions refer to, if any.
+}
+
+// NewLexerFile creates a new Lexer object that reads all of its input, which it
+// adds to the file set under the given name, so that Pos and End give
+// positions in it. It records the start of each line as it scans.
+func NewLexerFile(fset *yytoken.FileSet, name string, in io.Reader) *Lexer {
+  b, err := io.ReadAll(in)
+  var yylex *Lexer
+  if err != nil {
+    // Scan what was read, then meet the error as though reading it.
+    yylex = NewLexer(&failedReader{b, err})
+  } else {
+    yylex = NewLexerBytes(b)
+  }
+  yylex.file = fset.AddFile(name, -1, len(b))
+  return yylex
+}
+
+// A failedReader reads the given bytes, then fails with the given error.
+type failedReader struct {
+  b []byte
+  err error
+}
+
+func (r *failedReader) Read(p []byte) (int, error) {
+  if len(r.b) == 0 {
+    return 0, r.err
+  }
+  n := copy(p, r.b)
+  r.b = r.b[n:]
+  return n, nil
+}
+
+// Pos returns the position of the matched text in the file given to
+// NewLexerFile, or NoPos for other lexers.
+func (yylex *Lexer) Pos() yytoken.Pos {
+  return yylex.pos(yylex.Offset())
+}
+
+// End returns the position just past the matched text in the file given to
+// NewLexerFile, or NoPos for other lexers.
+func (yylex *Lexer) End() yytoken.Pos {
+  return yylex.pos(yylex.EndOffset())
+}
+
+// pos returns the position at the given offset in the file, if any.
+func (yylex *Lexer) pos(offset int) yytoken.Pos {
+  if yylex.file == nil {
+    return yytoken.NoPos
+  }
+  return yylex.file.Pos(offset)
+}
+
+// addLines records the start of each line that begins in the text of a frame
+// in the file, if any. Lines in text from Unput are not in the file, and the
+// file ignores lines it already has, such as those that a nested family scans
+// again.
+func (yylex *Lexer) addLines(f frame) {
+  if yylex.file == nil {
+    return
+  }
+  s := f.input()
+  for i := 0; i < len(s); i++ {
+    if s[i] == '\n' {
+      yylex.file.AddLine(f.offset + i + 1)
+    }
+  }
+}
+`
+
+// Without the -fileset option, a lexer has no file.
+var noFileText = `
+type fileState struct{}
+
+func (yylex *Lexer) addLines(f frame) {}
+`
+
 func writeLex(out *bufio.Writer, root rule) {
 	if !customError {
-		// TODO: I can't remember what this was for!
-		prefixReplacer.WriteString(out, `func (yylex Lexer) Error(e string) {
-  panic(e)
+		// Go's yacc reports syntax errors through this method.
+		prefixReplacer.WriteString(out, `// Error records a syntax error at the current match, or at the end of input
+// once Lex has returned 0, for Err to return. It leaves lexing to go on, in
+// case the parser recovers.
+func (yylex *Lexer) Error(e string) {
+  yylex.fail(yylex.Line(), yylex.Column(), yyerrors.New(e))
 }`)
 	}
 	prefixReplacer.WriteString(out, `
@@ -1011,7 +3930,11 @@ func writeNNFun(out *bufio.Writer, root rule) {
 }
 func process(output io.Writer, input io.Reader) error {
 	lineno := 1
-	in := bufio.NewReader(input)
+	src, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(strings.NewReader(string(src)))
 	out := bufio.NewWriter(output)
 	var r rune
 	read := func() bool {
@@ -1059,13 +3982,138 @@ func process(output io.Writer, input io.Reader) error {
 		}
 		return string(buf)
 	}
+	// Definitions such as "DIGIT [0-9]" lie in a section of their own before
+	// the rules, each on a line of its own.
+	hasDefs := hasDefinitions(string(src))
+	inDefs := hasDefs
+	defs := make(map[string]*definition)
+	readDef := func() error {
+		line := lineno
+		name := []rune{r}
+		for !read() && isNameRune(r) {
+			name = append(name, r)
+		}
+		if ' ' != r && '\t' != r {
+			return &lineError{line, ErrBadDefinition}
+		}
+		var regex []rune
+		for !read() && '\n' != r {
+			regex = append(regex, r)
+		}
+		regex = []rune(strings.TrimSpace(string(regex)))
+		if len(regex) == 0 {
+			return &lineError{line, ErrBadDefinition}
+		}
+		if defs[string(name)] != nil {
+			return &lineError{line, ErrDuplicateName}
+		}
+		defs[string(name)] = &definition{regex: regex, line: line}
+		return nil
+	}
+	// Declarations of start conditions such as "%x STRING" may lie among the
+	// definitions. The first condition is INITIAL.
+	conds := []condition{{"INITIAL", false}}
+	isDecl := func() bool {
+		b, err := in.Peek(2)
+		return '%' == r && err == nil && ('s' == b[0] || 'x' == b[0]) && (' ' == b[1] || '\t' == b[1])
+	}
+	readDecl := func() error {
+		line := lineno
+		read()
+		exclusive := 'x' == r
+		n := 0
+		for done := read(); !done && '\n' != r; {
+			if ' ' == r || '\t' == r {
+				done = read()
+				continue
+			}
+			if !isNameStart(r) {
+				return &lineError{line, ErrBadCondition}
+			}
+			name := []rune{r}
+			for done = read(); !done && isNameRune(r); done = read() {
+				name = append(name, r)
+			}
+			for _, c := range conds {
+				if c.name == string(name) {
+					return &lineError{line, ErrDuplicateName}
+				}
+			}
+			conds = append(conds, condition{string(name), exclusive})
+			n++
+		}
+		if 0 == n {
+			return &lineError{line, ErrBadCondition}
+		}
+		return nil
+	}
+	// A top-level rule may begin with the start conditions where it is
+	// active, as in "<STRING,COMMENT>/\n/", where "*" stands for all of them.
+	isPrefix := func() bool {
+		b, _ := in.Peek(utf8.UTFMax)
+		c, _ := utf8.DecodeRune(b)
+		return '<' == r && ('*' == c || isNameStart(c))
+	}
+	readPrefix := func() ([]string, error) {
+		line := lineno
+		var names []string
+		for '>' != r {
+			var name []rune
+			for !read() && (isNameRune(r) || '*' == r && 0 == len(name)) {
+				name = append(name, r)
+				if '*' == r {
+					read()
+					break
+				}
+			}
+			if 0 == len(name) || (',' != r && '>' != r) {
+				return nil, &lineError{line, ErrBadCondition}
+			}
+			found := "*" == string(name)
+			for _, c := range conds {
+				found = found || c.name == string(name)
+			}
+			if !found {
+				return nil, &lineError{line, ErrUndefinedCondition}
+			}
+			names = append(names, string(name))
+		}
+		if skipws() || '<' == r || '>' == r {
+			return nil, &lineError{line, ErrBadCondition}
+		}
+		return names, nil
+	}
 	var root rule
 	needRootRAngle := false
 	var parse func(*rule) error
 	parse = func(node *rule) error {
 		for {
 			panicIf(skipws, ErrUnexpectedEOF)
-			if '<' == r {
+			if inDefs {
+				if b, err := in.Peek(1); '%' == r && err == nil && '%' == b[0] {
+					// A line "%%" ends the section.
+					read()
+					inDefs = false
+					continue
+				}
+				var err error
+				if isDecl() {
+					err = readDecl()
+				} else {
+					err = readDef()
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			var prefix []string
+			if node == &root && isPrefix() {
+				var err error
+				if prefix, err = readPrefix(); err != nil {
+					return err
+				}
+			} else if '<' == r {
 				if node != &root || len(node.kid) > 0 {
 					panic(ErrUnexpectedLAngle)
 				}
@@ -1086,41 +4134,129 @@ func process(output io.Writer, input io.Reader) error {
 				return nil
 			}
 			delim := r
+			line := lineno
+			// Read up to the next unescaped delimiter, starting from r.
+			readRegex := func() ([]rune, error) {
+				var regex []rune
+				for {
+					if r == delim && (len(regex) == 0 || regex[len(regex)-1] != '\\') {
+						break
+					}
+					if '\n' == r {
+						return nil, ErrUnexpectedNewline
+					}
+					regex = append(regex, r)
+					panicIf(read, ErrUnexpectedEOF)
+				}
+				if !hasDefs {
+					return regex, nil
+				}
+				return expandDefs(regex, defs)
+			}
+			// True if r ends the regex, that is, it precedes the action.
+			isEnd := func(r rune) bool {
+				return strings.IndexRune(" \n\t\r{<", r) != -1
+			}
+			// True if r is a flag rather than the start of trailing context.
+			isFlag := func() bool {
+				b, err := in.Peek(1)
+				return 'i' == r && (err != nil || isEnd(rune(b[0])))
+			}
 			panicIf(read, ErrUnexpectedEOF)
-			var regex []rune
-			for {
-				if r == delim && (len(regex) == 0 || regex[len(regex)-1] != '\\') {
-					break
+			if delim == r {
+				if prefix != nil {
+					return &lineError{line, ErrBadCondition}
 				}
-				if '\n' == r {
-					return ErrUnexpectedNewline
+				break
+			}
+			regex, err := readRegex()
+			var trail []rune
+			panicIf(read, ErrUnexpectedEOF)
+			// Trailing context lies between a second pair of delimiters, as in
+			// /r/s/, while flags immediately follow the last delimiter.
+			if err == nil && !isEnd(r) && !isFlag() {
+				trail, err = readRegex()
+				if err == nil && len(trail) == 0 {
+					err = ErrEmptyTrail
 				}
-				regex = append(regex, r)
 				panicIf(read, ErrUnexpectedEOF)
 			}
-			if "" == string(regex) {
-				break
+			if err != nil {
+				if _, ok := err.(*lineError); !ok {
+					err = &lineError{line, err}
+				}
+				return err
+			}
+			fold := caseless
+			if isFlag() {
+				fold = true
+				panicIf(read, ErrUnexpectedEOF)
+			}
+			if strings.IndexRune(" \n\t\r", r) != -1 {
+				panicIf(skipws, ErrUnexpectedEOF)
 			}
-			panicIf(skipws, ErrUnexpectedEOF)
 			x := new(rule)
 			x.id = fmt.Sprintf("%d", lineno)
+			x.fold = fold
+			x.trail = trail
+			x.conds = prefix
 			node.kid = append(node.kid, x)
 			x.regex = make([]rune, len(regex))
 			copy(x.regex, regex)
 			if '<' == r {
 				panicIf(skipws, ErrUnexpectedEOF)
 				x.startCode = readCode()
-				parse(x)
+				if err := parse(x); err != nil {
+					return err
+				}
 			} else {
 				x.code = readCode()
 			}
 		}
 		return nil
 	}
-	err := parse(&root)
+	err = parse(&root)
 	if err != nil {
 		return err
 	}
+	// Each start condition has its own DFA.
+	var ds []*dfa
+	if 1 == len(conds) {
+		d, err := compileFamily(&root, nil)
+		if err != nil {
+			return err
+		}
+		ds = []*dfa{d}
+	} else {
+		for _, c := range conds {
+			active := make([]bool, len(root.kid))
+			for i, x := range root.kid {
+				active[i] = x.conds == nil && !c.exclusive
+				for _, name := range x.conds {
+					active[i] = active[i] || name == c.name || name == "*"
+				}
+			}
+			d, err := compileFamily(&root, active)
+			if err != nil {
+				return err
+			}
+			d.cond = c.name
+			ds = append(ds, d)
+		}
+	}
+	if err := checkDeadRules(ds); err != nil {
+		return err
+	}
+	if nodefault {
+		if err := checkCoverage(ds); err != nil {
+			return err
+		}
+	}
+	if conflicts {
+		writeTies(out, ds)
+		out.Flush()
+		return nil
+	}
 
 	buf = nil
 	for done := skipws(); !done; done = read() {
@@ -1151,12 +4287,93 @@ func process(output io.Writer, input io.Reader) error {
 		buf = buf[i+1:]
 	}
 
+	// The runtime imports packages the user's code might also import under
+	// other names, and the rest only where it needs them.
+	imports := []string{`"bufio"`}
+	if withContext {
+		imports = append(imports, `yycontext "context"`)
+	}
+	if nodefault || (!customError && !standalone) {
+		imports = append(imports, `yyerrors "errors"`)
+	}
+	if withFileSet {
+		imports = append(imports, `yytoken "go/token"`)
+	}
+	imports = append(imports, `"io"`, `yystrconv "strconv"`, `"strings"`)
+	if withContext {
+		imports = append(imports, `yytime "time"`)
+	}
+	imports = append(imports, `"unicode/utf8"`)
+	prefixReplacer.WriteString(out, "import ("+strings.Join(imports, ";")+")")
+	fmt.Fprintf(out, "\n\n// Set by the -invalid option.\nconst invalidBytes = %v\n", invalidBytes)
 	prefixReplacer.WriteString(out, lexertext)
 
-	for _, kid := range root.kid {
-		gen(out, kid)
+	// The backend writes the DFA of each start condition as a family, along
+	// with any tables the families share.
+	var write func(i int)
+	var writeShared func()
+	switch backend {
+	case "table":
+		prefixReplacer.WriteString(out, runeScannerText+tableText)
+		c := newRuneClasses(ds)
+		write = func(i int) { ds[i].writeTables(out, c) }
+		writeShared = func() { c.write(out) }
+	case "goto":
+		prefixReplacer.WriteString(out, gotoText)
+		write = func(i int) { ds[i].writeGoto(out) }
+	case "bytes":
+		prefixReplacer.WriteString(out, gotoText)
+		bs := make([]*byteDFA, len(ds))
+		for i, d := range ds {
+			bs[i] = newByteDFA(d)
+		}
+		class := byteClasses(bs)
+		write = func(i int) { bs[i].write(out, class) }
+		writeShared = func() { writeByteClasses(out, class) }
+	default:
+		prefixReplacer.WriteString(out, runeScannerText+closureText)
+		write = func(i int) { ds[i].writeClosures(out) }
+	}
+	if 1 == len(ds) {
+		out.WriteString("\nvar dfas = ")
+		write(0)
+		out.WriteString("\n")
+	} else {
+		out.WriteString("\nvar dfas = conditions[0]\n\n// The family of each start condition.\nvar conditions = []*family{\n")
+		for i := range ds {
+			write(i)
+			out.WriteString(",\n")
+		}
+		out.WriteString("}\n\n// The start conditions.\nconst (\n")
+		for i, c := range conds {
+			if 0 == i {
+				fmt.Fprintf(out, "%s = iota\n", c.name)
+			} else {
+				fmt.Fprintf(out, "%s\n", c.name)
+			}
+		}
+		out.WriteString(")\n")
+		prefixReplacer.WriteString(out, conditionsText)
+	}
+	if writeShared != nil {
+		writeShared()
 	}
 	prefixReplacer.WriteString(out, lexeroutro)
+	if withContext {
+		prefixReplacer.WriteString(out, contextText)
+	} else {
+		prefixReplacer.WriteString(out, noContextText)
+	}
+	if withFileSet {
+		prefixReplacer.WriteString(out, fileText)
+	} else {
+		prefixReplacer.WriteString(out, noFileText)
+	}
+	if nodefault {
+		prefixReplacer.WriteString(out, noDefaultText)
+	} else {
+		prefixReplacer.WriteString(out, unmatchedText)
+	}
 	if !standalone {
 		writeLex(out, root)
 		out.WriteString(string(buf))
@@ -4,7 +4,16 @@ import (
 	"bytes"
 	"crypto/md5"
 	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
 	"testing"
+	"unicode"
+	"unicode/utf8"
 )
 
 var testinput = `
@@ -18,9 +27,405 @@ func TestGenStable(t *testing.T) {
 		var out bytes.Buffer
 
 		process(&out, bytes.NewBufferString(testinput))
-		e := "13f760d2f0dc1743dd7165781f2a318d"
+		e := "a52590c2da407680dfd5c21f2977bafc"
 		if x := fmt.Sprintf("%x", md5.Sum(out.Bytes())); x != e {
 			t.Errorf("got: %s wanted: %s", x, e)
 		}
 	}
 }
+
+// Lexers import context, go/token and time only under the options that need
+// them.
+func TestOptionalImports(t *testing.T) {
+	defer func() {
+		withContext, withFileSet = false, false
+	}()
+	for _, x := range []struct {
+		context, fileSet bool
+		want             string
+	}{
+		{false, false, `"bufio" "errors" "io" "strconv" "strings" "unicode/utf8"`},
+		{true, false, `"bufio" "context" "errors" "io" "strconv" "strings" "time" "unicode/utf8"`},
+		{false, true, `"bufio" "errors" "go/token" "io" "strconv" "strings" "unicode/utf8"`},
+	} {
+		withContext, withFileSet = x.context, x.fileSet
+		var out bytes.Buffer
+		if err := process(&out, bytes.NewBufferString(testinput)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), "", out.Bytes(), parser.ImportsOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, spec := range f.Imports {
+			paths = append(paths, spec.Path.Value)
+		}
+		if got := strings.Join(paths, " "); got != x.want {
+			t.Errorf("-context=%v -fileset=%v: got %s, want %s", x.context, x.fileSet, got, x.want)
+		}
+	}
+}
+
+func TestRegexErrors(t *testing.T) {
+	defer func() { setOps = false }()
+	setOps = true
+	for _, x := range []struct {
+		regex string
+		err   error
+	}{
+		{"a{3,2}", ErrBadRepeatRange},
+		{"a{1001}", ErrRepeatTooLarge},
+		{"a{2,99999999999}", ErrRepeatTooLarge},
+		{`\p{Klingon}`, ErrBadProperty},
+		{`\p{L`, ErrUnmatchedLBrace},
+		{`[a-\pL]`, ErrBadRange},
+		{`[\d-z]`, ErrBadRange},
+		{`\q`, ErrBadBackslash},
+		{`\x4`, ErrBadBackslash},
+		{`\x{41`, ErrBadBackslash},
+		{`\u12g4`, ErrBadBackslash},
+		{`\e{valid}`, ErrBadBackslash},
+		{`[\e]`, ErrBadBackslash},
+		{`\e{invalid}`, ErrInvalidOption},
+		{`\x{110000}`, ErrBadCodePoint},
+		{`[\ud800]`, ErrBadCodePoint},
+		{`(?x:a)`, ErrBadGroupFlag},
+		{`~^a`, ErrAnchorInOperator},
+		{`a&b$`, ErrAnchorInOperator},
+	} {
+		func() {
+			defer func() {
+				if err := recover(); err != x.err {
+					t.Errorf("%s: got %v, want %v", x.regex, err, x.err)
+				}
+			}()
+			var out bytes.Buffer
+			process(&out, bytes.NewBufferString("/"+x.regex+"/ {}\n//\npackage main\n"))
+		}()
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	defer func() { setOps = false }()
+	for _, x := range []struct {
+		regex string
+		ops   bool
+		in    string
+		want  int // The length of the longest match, or -1 if there is none.
+	}{
+		{"&&", false, "&&", 2},
+		{"a&b", false, "a&b", 3},
+		{"a&b", true, "a&b", -1},
+		{"~", false, "~b", 1},
+		{"~", false, "a~b", -1},
+		{"~", true, "a~b", 3},
+		{"[a-z]+&~(if)", false, "iff", -1},
+		{"[a-z]+&~(if)", true, "iff", 3},
+		{"[a-z]+&~(if)", true, "if", 1},
+		{`\~|[&]`, true, "&", 1},
+	} {
+		setOps = x.ops
+		d, err := compileFamily(&rule{kid: []*rule{{regex: []rune(x.regex)}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, n := runeMatch(d, x.in); n != x.want {
+			t.Errorf("/%s/ (setops %v) on %q: got %d, want %d", x.regex, x.ops, x.in, n, x.want)
+		}
+	}
+}
+
+func TestLineErrors(t *testing.T) {
+	for _, x := range []struct {
+		spec string
+		line int
+		err  error
+	}{
+		{"A {B}\nB {A}\n%%\n/{A}/ {}\n", 2, ErrDefinitionCycle},
+		{"A {A}\n%%\n/x/ {}\n/{A}/ {}\n", 1, ErrDefinitionCycle},
+		{"A [a]\n%%\n/{X}/ {}\n", 3, ErrUndefinedName},
+		{"A [a]\n\n%%\n/{A}{C}/ {}\n", 4, ErrUndefinedName},
+		{"A [a]\nB {C}\n%%\n/{B}/ {}\n", 2, ErrUndefinedName},
+		{"A [a]\nA [b]\n%%\n", 2, ErrDuplicateName},
+		{"A\n%%\n/a/ {}\n", 1, ErrBadDefinition},
+		{"/a/ {}\n/b// {}\n", 2, ErrEmptyTrail},
+		{"/a/ {}\n/a*/b/ {}\n", 2, ErrEmptyHead},
+		{"/a/ {}\n\n/c*d/a+/ {}\n", 3, ErrVariableTrail},
+		{"/[a-z]+/ < {}\n/a/ {}\n/c*d/a+/ {}\n> {}\n", 3, ErrVariableTrail},
+		{"%x A\n%s B A\n%%\n", 2, ErrDuplicateName},
+		{"%s INITIAL\n%%\n", 1, ErrDuplicateName},
+		{"%x A 1\n%%\n", 1, ErrBadCondition},
+		{"%x A\n%%\n<B>/a/ {}\n", 3, ErrUndefinedCondition},
+		{"%x A\n%%\n<A/a/ {}\n", 3, ErrBadCondition},
+		{"%x A\n%%\n<A,>/a/ {}\n", 3, ErrBadCondition},
+		{"%x A\n%%\n/a/ {}\n<A>//\n", 4, ErrBadCondition},
+	} {
+		var out bytes.Buffer
+		err := process(&out, bytes.NewBufferString(x.spec+"//\npackage main\n"))
+		if e, ok := err.(*lineError); !ok || e.line != x.line || e.err != x.err {
+			t.Errorf("%q: got %v, want line %d: %v", x.spec, err, x.line, x.err)
+		}
+	}
+}
+
+func TestDeadRules(t *testing.T) {
+	warnOut = ioutil.Discard
+	defer func() {
+		warnOut = os.Stderr
+		strict = false
+		setOps = false
+	}()
+	strict = true
+	setOps = true
+	for _, x := range []struct {
+		spec string
+		line int // The line of the first dead rule, or 0 if there is none.
+	}{
+		{"/[a-z]+/ {}\n/if/ {}\n", 2},
+		{"/a|b/ {}\n/a/ {}\n/b/ {}\n", 2},
+		{"/a/ {}\n/b/ {}\n/a|b/ {}\n", 3},
+		{"/a&b/ {}\n", 1},
+		{"/a/ {}\n/a+/ {}\n", 0},
+		{"/a$/ {}\n/^a/ {}\n/a/ {}\n/^$/ {}\n", 0},
+		{"/a/ {}\n/^a/ {}\n", 2},
+		{"/a/ {}\n/a$/ {}\n", 2},
+		{"/a+/ < {}\n/a/ {}\n/b/ {}\n/a/ {}\n> {}\n", 4},
+		{"%x A\n%%\n<A>/a/ {}\n/a/ {}\n", 0},
+		{"%s A\n%%\n/a/ {}\n<*>/a/ {}\n", 4},
+		{"%x A\n%%\n/a/ {}\n<A>/b/ {}\n<*>/a|b/ {}\n", 0},
+		{"%x A\n%%\n/a/ {}\n<A>/b/ {}\n<A,INITIAL>/a|b/ {}\n/b/ {}\n", 6},
+		{"%a% {}\n/a/ {}\n", 2},
+	} {
+		var out bytes.Buffer
+		err := process(&out, bytes.NewBufferString(x.spec+"//\npackage main\n"))
+		if 0 == x.line {
+			if err != nil {
+				t.Errorf("%q: got %v, want no error", x.spec, err)
+			}
+			continue
+		}
+		if e, ok := err.(*lineError); !ok || e.line != x.line || e.err != ErrDeadRule {
+			t.Errorf("%q: got %v, want line %d: %v", x.spec, err, x.line, ErrDeadRule)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	warnOut = ioutil.Discard
+	defer func() {
+		warnOut = os.Stderr
+		conflicts = false
+	}()
+	conflicts = true
+	var out bytes.Buffer
+	process(&out, bytes.NewBufferString(`/[a-z]+/ {}
+/if/ {}
+/^x/ {}
+/[0-9]+$/ {}
+/[0-9][0-9]/ {}
+/$/ {}
+/$$/ {}
+/q/ < {}
+/q|r/ {}
+/./ {}
+> {}
+//
+package main
+`))
+	want := `lines 1 and 2 both match "if", and line 1 wins
+lines 1 and 3 both match "x" at the start of input, and line 1 wins
+lines 1 and 8 both match "q", and line 1 wins
+lines 4 and 5 both match "00" at the end of input, and line 4 wins
+lines 6 and 7 both match "" at the end of input, and line 6 wins
+lines 9 and 10 both match "q", and line 9 wins
+`
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	// Without the option, ties are not looked for.
+	conflicts = false
+	if d, _ := compileFamily(&rule{kid: []*rule{{regex: []rune("a")}, {regex: []rune("a")}}}, nil); d.ties != nil {
+		t.Errorf("found ties without -conflicts: %v", d.ties)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	var msgs bytes.Buffer
+	warnOut = &msgs
+	defer func() {
+		warnOut = os.Stderr
+		nodefault = false
+		invalidBytes = false
+	}()
+	nodefault = true
+	for _, x := range []struct {
+		spec, want string
+	}{
+		{"/[a-z]+/ {}\n/./ {}\n", ""},
+		{"/[a-z]+/ {}\n", `warning: input " " is not covered by any rule`},
+		{"/[ab]+/ {}\n/[^a]/ {}\n", ""},
+		{"/ab/ {}\n/b/ {}\n", `warning: input " " is not covered by any rule`},
+		{"/ab/ {}\n/b/ {}\n/[^a]/ {}\n", `warning: input "a" at the end of input is not covered by any rule`},
+		{"/ab/ {}\n/b/ {}\n/[^a]/ {}\n/a$/ {}\n", `warning: input "aa" is not covered by any rule`},
+		{"/a*$/ {}\n/b/ {}\n", `warning: input " " is not covered by any rule`},
+		{"/[a-z]/ {}\n/^[^a-z]/ {}\n", `warning: input " " is not covered by any rule except at the start of input`},
+		{"/[a-z]/ {}\n/^/ {}\n", `warning: input " " is not covered by any rule`},
+		{"/[^\\x{FFFD}]/ {}\n", "warning: input \"\ufffd\" is not covered by any rule"},
+		{"/[^\\e{invalid}]/ {}\n", `warning: input "\x80" is not covered by any rule`},
+		{"/[a-z]+/ < {}\n/[a-y]/ {}\n> {}\n/./ {}\n", `line 1: warning: input "z" is not covered by any rule nested in it`},
+		{"/a|[0-9]+/ < {}\n/[0-9]/ {}\n> {}\n/./ {}\n", `line 1: warning: input "a" is not covered by any rule nested in it`},
+		{"/[a-z]+/ < {}\n/[a-z]+/ {}\n> {}\n/./ {}\n", ""},
+		{"%x A\n%%\n/[a-z]/ {}\n<A>/./ {}\n", `warning: input " " is not covered by any rule in start condition INITIAL`},
+	} {
+		// Rules that match invalid bytes need the -invalid option.
+		invalidBytes = strings.Contains(x.spec, `\e{invalid}`)
+		msgs.Reset()
+		var out bytes.Buffer
+		if err := process(&out, bytes.NewBufferString(x.spec+"//\npackage main\n")); err != nil {
+			t.Errorf("%q: %v", x.spec, err)
+		}
+		if got := strings.TrimSpace(msgs.String()); got != x.want {
+			t.Errorf("%q: got %q, want %q", x.spec, got, x.want)
+		}
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	defer func() { noMinimize = false }()
+	for _, x := range []struct {
+		min  bool
+		want int
+	}{
+		{false, 5},
+		{true, 3},
+	} {
+		noMinimize = !x.min
+		var out bytes.Buffer
+		process(&out, bytes.NewBufferString("/(a|b)(c|d)/ {}\n//\npackage main\n"))
+		if got := strings.Count(out.String(), "func(r rune) int"); got != x.want {
+			t.Errorf("minimize %v: got %d states, want %d", x.min, got, x.want)
+		}
+	}
+}
+
+// Returns the longest match of the DFA at the start of the input.
+func runeMatch(d *dfa, in string) (int, int) {
+	lo, letter := d.ranges()
+	matchi, matchn := 0, -1
+	for st, p := 0, 0; p < len(in); {
+		r, n := utf8.DecodeRuneInString(in[p:])
+		if 1 == n && r == utf8.RuneError {
+			r = invalidRune(in[p])
+		}
+		p += n
+		k := sort.Search(len(lo), func(k int) bool { return lo[k] > r }) - 1
+		if st = d.trans[st][letter[k]]; -1 == st {
+			break
+		}
+		if -1 != d.acc[st] {
+			matchi, matchn = d.acc[st], p
+		}
+	}
+	return matchi, matchn
+}
+
+// Returns the longest match of the byte DFA at the start of the input.
+func byteMatch(b *byteDFA, in string) (int, int) {
+	n := len(b.d.trans)
+	matchi, matchn := 0, -1
+	for st, p := 0, 0; -1 != st; {
+		if st >= n && (p == len(in) || breakOff == b.trans[st][in[p]]) {
+			x := b.back[st]
+			if -1 != x.rule {
+				matchi, matchn = x.rule, p-x.n
+			}
+			st = x.state
+		} else if p < len(in) {
+			st = b.trans[st][in[p]]
+			p++
+		} else {
+			break
+		}
+		if -1 != st && st < n && -1 != b.d.acc[st] {
+			matchi, matchn = b.d.acc[st], p
+		}
+	}
+	return matchi, matchn
+}
+
+func TestFoldLimits(t *testing.T) {
+	// Fold the runes of a range one at a time.
+	slow := func(lo, hi rune) []rune {
+		var lim []rune
+		for c := lo; c <= hi; c++ {
+			lim = append(lim, c, c)
+			for f := unicode.SimpleFold(c); f != c; f = unicode.SimpleFold(f) {
+				lim = append(lim, f, f)
+			}
+		}
+		return normalizeLimits(lim)
+	}
+	check := func(lo, hi rune) {
+		want, got := slow(lo, hi), foldLimits([]rune{lo, hi})
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Fatalf("[%#x-%#x]: want %x, got %x", lo, hi, want, got)
+		}
+	}
+	for _, cr := range unicode.CaseRanges {
+		for c := rune(cr.Lo); c <= rune(cr.Hi); c++ {
+			check(c, c)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		lo := rune(rnd.Intn(0x1f000))
+		check(lo, lo+rune(rnd.Intn(300)))
+	}
+	check(0, 0x1f000)
+}
+
+func TestByteDFA(t *testing.T) {
+	pieces := []string{"a", "é", "中", "😀", "\ufffd", "\xff", "\xe4\xb8", "\xed\xa0\x80",
+		"\xc0\xaf", "\xe0\x80", "\xf0\x9f", "\xf4\x90\x80\x80"}
+	rnd := rand.New(rand.NewSource(1))
+	defer func() { invalidBytes = false }()
+	for _, x := range []struct {
+		regex   string
+		invalid bool
+	}{
+		{".", false},
+		{"[^a]+", false},
+		{"中|a.", false},
+		{`\x{FFFD}[^中]`, false},
+		{`[é-\x{10000}]+a?`, false},
+		{"(.中)*😀", false},
+		{".", true},
+		{"[^a]+", true},
+		{"中|a.", true},
+		{`\x{FFFD}[^中]`, true},
+		{`[é-\x{10000}]+a?`, true},
+		{"(.中)*😀", true},
+		{`\e{invalid}+`, true},
+		{`[\e{invalid}中]\e{invalid}`, true},
+		{`[^\e{invalid}]+`, true},
+	} {
+		invalidBytes = x.invalid
+		d, err := compileFamily(&rule{kid: []*rule{{regex: []rune(x.regex)}, {regex: []rune("a+")}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newByteDFA(d)
+		for i := 0; i < 1000; i++ {
+			in := ""
+			for j := rnd.Intn(6); j > 0; j-- {
+				in += pieces[rnd.Intn(len(pieces))]
+			}
+			ri, rn := runeMatch(d, in)
+			bi, bn := byteMatch(b, in)
+			if ri != bi || rn != bn {
+				t.Fatalf("/%s/ (invalid %v) on %q: rune DFA matches %d, %d; byte DFA matches %d, %d", x.regex, x.invalid, in, ri, rn, bi, bn)
+			}
+		}
+	}
+}
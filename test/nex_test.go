@@ -33,7 +33,7 @@ func init() {
 	panic("cannot find nex binary")
 }
 
-func dieErr(t *testing.T, err error, s string) {
+func dieErr(t testing.TB, err error, s string) {
 	if err != nil {
 		t.Fatalf("%s: %s", s, err)
 	}
@@ -75,6 +75,38 @@ func TestNexPlusYacc(t *testing.T) {
 	}
 }
 
+// Options under which the tests run each program.
+var programOptions = [][]string{
+	nil,
+	{"-nomin"},
+	{"-backend", "table"},
+	{"-backend", "goto"},
+	{"-backend", "bytes"},
+}
+
+// runProgram writes a nex program to a temporary directory and runs it with the
+// given flags under each of the given options, on the given input, failing
+// unless it prints want.
+func runProgram(t *testing.T, name, prog, in, want string, opts [][]string, flags ...string) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, name)
+	dieErr(t, ioutil.WriteFile(spec, []byte(prog), 0666), "WriteFile")
+	for _, opt := range opts {
+		args := append(append([]string{"-r"}, flags...), opt...)
+		cmd := exec.Command(nexBin, append(args, spec)...)
+		cmd.Stdin = strings.NewReader(in)
+		got, err := cmd.CombinedOutput()
+		dieErr(t, err, name+" "+string(got))
+		if string(got) != want {
+			t.Fatalf("%s %v: want %q, got %q", name, opt, want, string(got))
+		}
+	}
+}
+
 func TestNexPrograms(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "nex")
 	dieErr(t, err, "TempDir")
@@ -261,14 +293,516 @@ rect 11 12 16 17
 		{"u.nex", "١ + ٢ + ... + ١٨ = 一百五十三", "1 + 2 + ... + 18 = 153"},
 		{"bug50.nex", "# comment 1\nhello42:\n# comment 2\n\na\nblah:42x\n", "COMMENT: # comment 1\nTEXT: hello42\nERROR: :\nCOMMENT: # comment 2\nTEXT: a\nTEXT: blah:42x\n"},
 	} {
-		cmd := exec.Command(nexBin, "-r", "-s", x.prog)
-		cmd.Stdin = strings.NewReader(x.in)
-		got, err := cmd.CombinedOutput()
-		dieErr(t, err, x.prog+" "+string(got))
-		if string(got) != x.out {
-			t.Fatalf("program: %s\nwant %q, got %q", x.prog, x.out, string(got))
+		// Every option affecting code generation must yield the same output.
+		for _, opt := range programOptions {
+			args := append([]string{"-r", "-s"}, opt...)
+			cmd := exec.Command(nexBin, append(args, x.prog)...)
+			cmd.Stdin = strings.NewReader(x.in)
+			got, err := cmd.CombinedOutput()
+			dieErr(t, err, x.prog+" "+string(got))
+			if string(got) != x.out {
+				t.Fatalf("program: %s %v\nwant %q, got %q", x.prog, opt, x.out, string(got))
+			}
+		}
+	}
+}
+
+// A lexer that scans bytes that are not all valid UTF-8. Each invalid byte
+// reads as U+FFFD, but counts as one byte of input.
+var bytesProgram = `/[a-z]+/      { fmt.Println("word", yylex.Text()) }
+/\x{FFFD}/    { fmt.Printf("replacement %q %d-%d\n", yylex.Text(), yylex.Offset(), yylex.EndOffset()) }
+/./           { fmt.Println("other") }
+//
+package main
+import "fmt"
+func main() {
+  lex := NewLexerBytes([]byte("ab\xffcd \u4e2d\ufffd\xe4\xb8"))
+  NN_FUN(lex)
+}
+`
+
+// The same lexer under the -invalid option, where a rule matches invalid bytes
+// and U+FFFD only matches itself.
+var invalidProgram = "/\\e{invalid}/ { fmt.Printf(\"invalid %q\\n\", yylex.Text()) }\n" + bytesProgram
+
+func TestLexerBytes(t *testing.T) {
+	want := "word ab\nreplacement \"\ufffd\" 2-3\nword cd\nother\nother\nreplacement \"\ufffd\" 9-12\n" +
+		"replacement \"\ufffd\" 12-13\nreplacement \"\ufffd\" 13-14\n"
+	runProgram(t, "bytes.nex", bytesProgram, "", want, programOptions, "-s")
+	want = "word ab\ninvalid \"\\xff\"\nword cd\nother\nother\nreplacement \"\ufffd\" 9-12\n" +
+		"invalid \"\\xe4\"\ninvalid \"\\xb8\"\n"
+	runProgram(t, "invalid.nex", invalidProgram, "", want, programOptions, "-s", "-invalid")
+}
+
+// A lexer that counts the memory allocations made while it scans many tokens.
+var allocsProgram = `/[a-z]+/ { n++ }
+/[ \n]+/ { }
+//
+package main
+import ("bytes";"fmt";"runtime")
+var n int
+func main() {
+  in := bytes.Repeat([]byte("hello world foo bar\n"), 10000)
+  var before, after runtime.MemStats
+  runtime.ReadMemStats(&before)
+  NN_FUN(NewLexerBytes(in))
+  runtime.ReadMemStats(&after)
+  fmt.Println(n, after.Mallocs - before.Mallocs < 100)
+}
+`
+
+// The goto and bytes backends slice the text of each token from their input
+// rather than allocating it.
+func TestTextAllocs(t *testing.T) {
+	backends := [][]string{{"-backend", "goto"}, {"-backend", "bytes"}}
+	runProgram(t, "allocs.nex", allocsProgram, "", "40000 true\n", backends, "-s")
+}
+
+// A lexer that passes input no rule matches, even in a nested family, to a
+// function. Without the function, there is no default rule, and lexing stops.
+// It imports strconv, as does the runtime under -nodefault. Under -invalid, an
+// invalid byte reaches the function as it is.
+var unmatchedProgram = `/[a-z]+/ < { fmt.Println("word", yylex.Text()) }
+  /[a-y]/   { }
+>           { }
+/[0-9]+/    { fmt.Println("number", yylex.Text()) }
+/ /         { }
+//
+package main
+import ("fmt";"strconv")
+func main() {
+  lex := NewLexerBytes([]byte("ab 12 @z\xff"))
+  lex.OnUnmatched(func(s string, line, column int) {
+    fmt.Println("unmatched", strconv.Quote(s), line, column)
+  })
+  NN_FUN(lex)
+  fmt.Println(lex.Err())
+  lex = NewLexerBytes([]byte("ab 12 @z\xff"))
+  NN_FUN(lex)
+  fmt.Println(lex.Err())
+}
+`
+
+func TestUnmatched(t *testing.T) {
+	want := "warning: input \"!\" is not covered by any rule\n" +
+		"line 1: warning: input \"z\" is not covered by any rule nested in it\n" +
+		"word ab\nnumber 12\nunmatched \"@\" 0 6\nword z\nunmatched \"z\" 0 7\nunmatched \"\\xff\" 0 8\n<nil>\n" +
+		"word ab\nnumber 12\nline 1, column 7: input \"@\" is not covered by any rule\n"
+	runProgram(t, "unmatched.nex", unmatchedProgram, "", want, programOptions, "-s", "-nodefault", "-invalid")
+}
+
+// A lexer that reads one byte at a time, so that a rune no rule matches can
+// be split across reads, after a truncated sequence of the same length.
+var splitRuneProgram = `/a/ { fmt.Println("a") }
+//
+package main
+import ("bytes";"fmt";"strconv";"testing/iotest")
+func main() {
+  lex := NewLexer(iotest.OneByteReader(bytes.NewReader([]byte("\xe4\xb8\xe4\xb8\xada"))))
+  lex.OnUnmatched(func(s string, line, column int) {
+    fmt.Println("unmatched", strconv.Quote(s), line, column)
+  })
+  NN_FUN(lex)
+}
+`
+
+func TestSplitRune(t *testing.T) {
+	want := "warning: input \" \" is not covered by any rule\n" +
+		"unmatched \"\ufffd\" 0 0\nunmatched \"\ufffd\" 0 1\nunmatched \"中\" 0 2\na\n"
+	runProgram(t, "splitrune.nex", splitRuneProgram, "", want, programOptions, "-s", "-nodefault")
+}
+
+// A lexer whose reader fails partway through a token. It reports the error
+// rather than the partial token.
+var readErrorProgram = `/[a-z]+/ { fmt.Println("word", yylex.Text()) }
+/[ \n]/  { }
+//
+package main
+import ("errors";"fmt")
+var errReset = errors.New("connection reset")
+type flaky struct { s string }
+func (r *flaky) Read(p []byte) (int, error) {
+  if r.s == "" {
+    return 0, errReset
+  }
+  n := copy(p, r.s)
+  r.s = r.s[n:]
+  return n, nil
+}
+func main() {
+  lex := NewLexer(&flaky{"ab cd\nef"})
+  NN_FUN(lex)
+  err := lex.Err()
+  e, ok := err.(*LexError)
+  fmt.Println(err, ok && e.Line == 1 && e.Column == 2, errors.Is(err, errReset))
+}
+`
+
+func TestReadError(t *testing.T) {
+	want := "word ab\nword cd\nline 2, column 3: connection reset true true\n"
+	runProgram(t, "readerror.nex", readErrorProgram, "", want, programOptions, "-s")
+}
+
+// A parser's syntax errors, reported through Error at a token and, as yacc
+// reports "unexpected $end", once Lex has returned 0.
+var syntaxErrorProgram = `/[a-z]+/ { return 1 }
+/[ \n]/  { }
+//
+package main
+import "fmt"
+type yySymType struct{}
+func main() {
+  lex := NewLexerBytes([]byte("ab cd\nef"))
+  for lex.Lex(nil) != 0 {
+    if lex.Text() == "cd" {
+      lex.Error("syntax error")
+    }
+  }
+  fmt.Println(lex.Err())
+  lex = NewLexerBytes([]byte("ab cd\nef "))
+  for lex.Lex(nil) != 0 {
+  }
+  lex.Error("unexpected $end")
+  fmt.Println(lex.Err())
+}
+`
+
+func TestSyntaxError(t *testing.T) {
+	want := "line 1, column 4: syntax error\nline 2, column 4: unexpected $end\n"
+	runProgram(t, "syntaxerror.nex", syntaxErrorProgram, "", want, programOptions)
+}
+
+// A lexer that stops when its context is done: once an action cancels it, and
+// once a deadline passes while its reader blocks. A blocked read of a pipe is
+// cut short, so that no goroutine outlives the lexer, and the pipe can be read
+// again afterwards. A context that can never be done needs no goroutine at all.
+var contextProgram = `/[a-z]+/ { fmt.Println("word", yylex.Text())
+  if yylex.Text() == "stop" {
+    cancel()
+  }
+}
+/ /      { }
+//
+package main
+import ("bytes";"context";"errors";"fmt";"os";"runtime";"time")
+var cancel context.CancelFunc
+// A reader that blocks forever once it has read its string.
+type stuck struct { s string }
+func (r *stuck) Read(p []byte) (int, error) {
+  if r.s == "" {
+    select {}
+  }
+  n := copy(p, r.s)
+  r.s = r.s[n:]
+  return n, nil
+}
+func main() {
+  ctx, c := context.WithCancel(context.Background())
+  cancel = c
+  lex := NewLexerContext(ctx, &stuck{"ab stop cd"})
+  NN_FUN(lex)
+  fmt.Println(lex.Err(), errors.Is(lex.Err(), context.Canceled))
+  ctx, c = context.WithTimeout(context.Background(), 50 * time.Millisecond)
+  defer c()
+  lex = NewLexerContext(ctx, &stuck{"ab "})
+  NN_FUN(lex)
+  fmt.Println(lex.Err(), errors.Is(lex.Err(), context.DeadlineExceeded))
+  n := runtime.NumGoroutine()
+  r, w, _ := os.Pipe()
+  w.WriteString("cd ")
+  ctx, c = context.WithTimeout(context.Background(), 50 * time.Millisecond)
+  defer c()
+  lex = NewLexerContext(ctx, r)
+  NN_FUN(lex)
+  time.Sleep(10 * time.Millisecond)
+  fmt.Println(lex.Err(), runtime.NumGoroutine() == n)
+  w.WriteString("gh")
+  b := make([]byte, 2)
+  _, err := r.Read(b)
+  fmt.Println(string(b), err)
+  lex = NewLexerContext(context.Background(), bytes.NewReader([]byte("ef")))
+  NN_FUN(lex)
+  fmt.Println(lex.Err(), runtime.NumGoroutine() == n)
+}
+`
+
+func TestLexerContext(t *testing.T) {
+	want := `word ab
+word stop
+line 1, column 8: context canceled true
+word ab
+line 1, column 4: context deadline exceeded true
+word cd
+line 1, column 4: context deadline exceeded true
+gh <nil>
+word ef
+<nil> true
+`
+	runProgram(t, "context.nex", contextProgram, "", want, programOptions, "-s", "-context")
+}
+
+// A lexer that prints the start and end of each token, including those of a
+// nested family, which count from the start of the input.
+var positionsProgram = `/[a-zé]+/ < { show(yylex, "word") }
+  /é/        { show(yylex, "e") }
+  /[a-z]/    { }
+>            { }
+/"[^"]*"/    { show(yylex, "string") }
+/\e{invalid}/ { show(yylex, "invalid") }
+/[ \n]/      { }
+//
+package main
+import "fmt"
+var input = "ab café\n\xff \"x\ny\" été"
+func show(yylex *Lexer, kind string) {
+  fmt.Printf("%s %d:%d-%d:%d %d-%d %v\n", kind, yylex.Line(), yylex.Column(), yylex.EndLine(), yylex.EndColumn(),
+    yylex.Offset(), yylex.EndOffset(), input[yylex.Offset():yylex.EndOffset()] == yylex.Text())
+}
+func main() {
+  NN_FUN(NewLexerBytes([]byte(input)))
+}
+`
+
+func TestPositions(t *testing.T) {
+	want := `word 0:0-0:2 0-2 true
+word 0:3-0:7 3-8 true
+e 0:6-0:7 6-8 true
+invalid 1:0-1:1 9-10 true
+string 1:2-2:2 11-16 true
+word 2:3-2:6 17-22 true
+e 2:3-2:4 17-19 true
+e 2:5-2:6 20-22 true
+`
+	runProgram(t, "positions.nex", positionsProgram, "", want, programOptions, "-s", "-invalid")
+}
+
+// A lexer that gives go/token positions in a file that follows another in the
+// same file set. The nested family finds the multibyte rune of each word, and
+// "!" inserts a string whose newline is not a line of the file.
+var fileProgram = `/[a-zé]+/ < { show(yylex) }
+  /é/        { show(yylex) }
+  /[a-z]/    { }
+>            { }
+/"[^"]*"/    { show(yylex) }
+/!/          { yylex.Unput("\"\nu\"") }
+/[ \n]/      { }
+//
+package main
+import ("bytes";"fmt";"go/token")
+var fset = token.NewFileSet()
+func show(yylex *Lexer) {
+  fmt.Printf("%q %v %v\n", yylex.Text(), fset.Position(yylex.Pos()), fset.Position(yylex.End()))
+}
+func main() {
+  fset.AddFile("other.txt", -1, 10)
+  lex := NewLexerFile(fset, "in.txt", bytes.NewReader([]byte("ab\ncafé !\"x\ny\"\n  z")))
+  NN_FUN(lex)
+  fmt.Println(fset.File(lex.Pos()).LineCount(), NewLexerBytes(nil).Pos() == token.NoPos)
+}
+`
+
+func TestLexerFile(t *testing.T) {
+	want := `"ab" in.txt:1:1 in.txt:1:3
+"café" in.txt:2:1 in.txt:2:6
+"é" in.txt:2:4 in.txt:2:6
+"\"\nu\"" in.txt:2:8 in.txt:2:8
+"\"x\ny\"" in.txt:2:8 in.txt:3:3
+"z" in.txt:4:3 in.txt:4:4
+4 true
+`
+	runProgram(t, "file.nex", fileProgram, "", want, programOptions, "-s", "-fileset")
+}
+
+// A filter that copies its input to the output, except where rules say
+// otherwise. The nested family passes input no rule matches to a function.
+// Under -invalid, invalid bytes are copied as they are.
+var echoProgram = `/colou?r/     { os.Stdout.WriteString("COLOR") }
+/[0-9]+/      { yylex.Echo(); yylex.Echo() }
+/\{[^}]*\}/ < {
+    yylex.OnUnmatched(func(s string, line, column int) {
+      os.Stdout.WriteString("[" + s + "]")
+    })
+  }
+  /x/         { yylex.Echo() }
+>             { }
+//
+package main
+import "os"
+func main() {
+  lex := NewLexerWithInit(os.Stdin, func(yylex *Lexer) {
+    yylex.SetOutput(os.Stdout)
+  })
+  NN_FUN(lex)
+}
+`
+
+func TestEcho(t *testing.T) {
+	want := "the COLOR 1212 [{][a]x[b][}] red\xff\n"
+	runProgram(t, "echo.nex", echoProgram, "the colour 12 {axb} red\xff\n", want, programOptions, "-s", "-invalid")
+}
+
+// A lexer with start conditions for strings, comments that may nest within
+// parentheses, and parentheses, whose rules include those without a condition.
+// A bracket begins PAREN without saving a condition, so that the parenthesis
+// that closes it pops an empty stack.
+var conditionsProgram = `%x STR COMMENT
+%s PAREN
+%%
+/"/                   { yylex.Begin(STR); fmt.Print("<") }
+<STR>/[^"\\]+/        { fmt.Printf("[%s]", yylex.Text()) }
+<STR>/\\./            { fmt.Printf("\\%s", yylex.Text()[1:]) }
+<STR>/"/              { yylex.Begin(INITIAL); fmt.Print(">") }
+<INITIAL,PAREN>/\/\*/ { yylex.PushState(COMMENT) }
+<COMMENT>/\*\//       { yylex.PopState() }
+<COMMENT>/./          { }
+/\(/                  { yylex.PushState(PAREN); fmt.Print("(") }
+<PAREN>/\)/           { yylex.PopState(); fmt.Print(")") }
+/\[/                  { yylex.Begin(PAREN); fmt.Print("[") }
+<*>/\n/               { fmt.Println(yylex.State()) }
+/[a-z]+/              { fmt.Print(yylex.Text()) }
+//
+package main
+import "fmt"
+func main() {
+  NN_FUN(NewLexerBytes([]byte("ab \"x\\\"y /* z\" c (d /* q ) */ e)\n[f)g\n(\"s\n(\n")))
+}
+`
+
+func TestStartConditions(t *testing.T) {
+	want := "ab<[x]\\\"[y /* z]>c(de)0\n[f)g0\n(<[s\n(\n]"
+	runProgram(t, "conditions.nex", conditionsProgram, "", want, programOptions, "-s")
+}
+
+// A lexer whose actions return text to the input: a number gives back a
+// trailing dot, the code at the start of a nested family keeps only part of the
+// match, a nested rule keeps one letter at a time, and "!" and "%" insert text,
+// which takes up no room in positions, even when matched along with input.
+var lessProgram = `/[0-9]+\.[0-9]*/ { if t := yylex.Text(); t[len(t) - 1] == '.' {
+    yylex.Less(len(t) - 1)
+  }
+  fmt.Printf("num %q %d:%d %d-%d\n", yylex.Text(), yylex.Line(), yylex.Column(), yylex.Offset(), yylex.EndOffset())
+}
+/\./         { fmt.Println("dot") }
+/#[a-z]+#/ < { yylex.Less(3) }
+  /#/        { }
+  /[a-z]+/   { yylex.Less(1); fmt.Printf("letter %q %d:%d\n", yylex.Text(), yylex.Line(), yylex.Column()) }
+>            { fmt.Println("end") }
+/#/          { fmt.Println("hash") }
+/%/          { yylex.Unput("12.") }
+/!/          { yylex.Unput("ab\n"); fmt.Printf("bang %d:%d\n", yylex.Line(), yylex.Column()) }
+/[a-z]+/     { fmt.Printf("word %q %d:%d %d-%d\n", yylex.Text(), yylex.Line(), yylex.Column(), yylex.Offset(), yylex.EndOffset()) }
+/[ \n]/      { }
+//
+package main
+import "fmt"
+func main() {
+  NN_FUN(NewLexerBytes([]byte("3.x 1.5\n#abcd# !\nq %x %5")))
+}
+`
+
+func TestLess(t *testing.T) {
+	want := `num "3" 0:0 0-1
+dot
+word "x" 0:2 2-3
+num "1.5" 0:4 4-7
+letter "a" 1:1
+letter "b" 1:2
+end
+word "cd" 1:3 11-13
+hash
+bang 1:7
+word "ab" 1:8 16-16
+word "q" 2:0 17-18
+num "12" 2:3 20-20
+dot
+word "x" 2:3 20-21
+num "12.5" 2:6 23-24
+`
+	runProgram(t, "less.nex", lessProgram, "", want, programOptions, "-s")
+}
+
+// A lexer that prints a letter for each match, for the -setops option, under
+// which ~ and & are complement and intersection.
+var setOpsProgram = `/\/\*(~(.*\*\/.*))\*\// { s += "C" }
+/[a-z]+&~(if|then)/     { s += "I" }
+/[a-z]+/                { s += "K" }
+/\~|[&]/                { s += "E" }
+/./                     { s += "." }
+//
+package main
+import ("fmt";"os")
+func main() {
+  s := ""
+  NN_FUN(NewLexer(os.Stdin))
+  fmt.Println(s)
+}
+`
+
+// The same letters for rules whose ~ and & are literals, as they are without
+// the option.
+var literalOpsProgram = `/&&/  { s += "A" }
+/a&b/ { s += "B" }
+/~/   { s += "T" }
+/./   { s += "." }
+//
+package main
+import ("fmt";"os")
+func main() {
+  s := ""
+  NN_FUN(NewLexer(os.Stdin))
+  fmt.Println(s)
+}
+`
+
+func TestSetOps(t *testing.T) {
+	runProgram(t, "setops.nex", setOpsProgram, "x/* a * b */if iff~&", "ICK.IEE\n", programOptions, "-s", "-setops")
+	runProgram(t, "literalops.nex", literalOpsProgram, "&&a&b~x~&", "ABT.T.\n", programOptions, "-s")
+}
+
+// go vet reports nothing in the code nex generates, such as unreachable code,
+// under each backend and each option that adds to the runtime.
+func TestVet(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	for i, x := range []struct {
+		prog  string
+		flags []string
+	}{
+		{syntaxErrorProgram, nil},
+		{lessProgram, []string{"-s"}},
+		{conditionsProgram, []string{"-s"}},
+		{unmatchedProgram, []string{"-s", "-nodefault", "-invalid"}},
+		{contextProgram, []string{"-s", "-context"}},
+		{fileProgram, []string{"-s", "-fileset"}},
+	} {
+		for k, opt := range programOptions {
+			dir := filepath.Join(tmpdir, fmt.Sprintf("vet%v_%v", i, k))
+			dieErr(t, os.Mkdir(dir, 0777), "Mkdir")
+			spec := filepath.Join(dir, "vet.nex")
+			dieErr(t, ioutil.WriteFile(spec, []byte(x.prog), 0666), "WriteFile")
+			args := append(append([]string{"-o", filepath.Join(dir, "vet.go")}, x.flags...), opt...)
+			out, err := exec.Command(nexBin, append(args, spec)...).CombinedOutput()
+			dieErr(t, err, "nex: "+string(out))
 		}
 	}
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = tmpdir
+	out, err := cmd.CombinedOutput()
+	dieErr(t, err, "go vet: "+string(out))
+}
+
+func TestCaselessOption(t *testing.T) {
+	cmd := exec.Command(nexBin, "-r", "-s", "-i", "toy.nex")
+	cmd.Stdin = strings.NewReader("IF x Then 1")
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, "toy.nex "+string(got))
+	want := "A keyword: IF\nAn identifier: x\nA keyword: Then\nAn integer: 1\n"
+	if string(got) != want {
+		t.Fatalf("want %q, got %q", want, string(got))
+	}
 }
 
 // To save time, we combine several test cases into a single nex program.
@@ -298,7 +832,7 @@ func TestGiantProgram(t *testing.T) {
   /$/       { *lval += "." }
 >           { *lval += "]" }
 `, "a b c d e f g aaab aaaa eeeg fffe quxqux quxq quxe",
-			"[0][.][.][.][1][1][.][.][0][.][1][2][2][21]"},
+			"[0][.][.][.][1][1][.][.][0][.][1][2][2.][21]"},
 		// Exercise ^ and rule precedence.
 		{`
 /[a-z]*/ <  { *lval += "[" }
@@ -394,19 +928,127 @@ func TestGiantProgram(t *testing.T) {
 /[m-n]+[k-p]+[^k-r]+[o-p]+/ { *lval += "1" }
 /./ { *(*string)(lval) += yylex.Text() }
 `, "abcdefghijmnopabcoq", "0ij1q"},
+
+		// A negated class and a range overlapping one of its singles.
+		{`
+/[^a]|[a-c]q/ { *lval += "M" }
+/./ { *lval += "." }
+`, "bzacq", "MM.M"},
+
+		// Counted repetition. A '{' that does not follow a term, or that does
+		// not begin a count, is an ordinary rune.
+		{`
+/[0-9]{4}-[0-9]{2}-[0-9]{2}/ { *lval += "D" }
+/a{2,}/ { *lval += "A" }
+/b{1,2}/ { *lval += "B" }
+/(xy){0}z/ { *lval += "Z" }
+/c{,2}/ { *lval += "C" }
+/{[^\{\}]*}/ { *lval += "{}" }
+/./ { *lval += "." }
+`, "2024-01-15 aaa a bbb z c{,2} {x}", "D.A...BB.Z.C.{}"},
+
+		// Unicode classes.
+		{`
+/\p{Greek}+/ { *lval += "G" }
+/\p{Han}+/ { *lval += "H" }
+/[\p{Lu}0-9]+/ { *lval += "U" }
+/\pN/ { *lval += "N" }
+/[^\P{L}a-z]/ { *lval += "^" }
+/\P{L}/ { *lval += "." }
+/\p{L}/ { *lval += "l" }
+`, "αβγ 中文 ABC1 ٣ é b", "G.H.U.N.^.l"},
+
+		// Perl-style classes.
+		{`
+/\d+/ { *lval += "D" }
+/\w+/ { *lval += "W" }
+/\s+/ { *lval += "S" }
+/[\D\d]/ { *lval += "." }
+/[^\s\w\-]+/ { *lval += "P" }
+`, "x_1 42\t\n@#-", "WSDSP."},
+
+		// Code point escapes.
+		{`
+/\x41\x{42}\u0043/ { *lval += "L" }
+/[\x{200B}\uFEFF]/ { *lval += "Z" }
+/[\x30-\x{39}]+/ { *lval += "D" }
+/\011/ { *lval += "T" }
+/./ { *lval += "." }
+`, "ABC\u200b12\tx", "LZDT."},
+
+		// An escaped hyphen in a class is literal.
+		{`
+/[a\x2dz]+/ { *lval += "H" }
+/[0\-9]+/ { *lval += "E" }
+/./ { *lval += "." }
+`, "a-zb0-95", "H.E."},
+
+		// Case-insensitive rules and groups.
+		{`
+/select|from/i { *lval += "K" }
+/(?i:ab)c/ { *lval += "A" }
+/k/i { *lval += "k" }
+/[a-c]+/i { *lval += "C" }
+/./ { *lval += "." }
+`, "SELECT From abc ABc abC K \u212a", "K.K.A.A.C.k.k"},
+
+		// Definitions.
+		{`
+DIGIT [0-9]
+L     [a-zA-Z_]
+ID    {L}({L}|{DIGIT})*
+NUM   {DIGIT}+(\.{DIGIT}+)?
+%%
+/{ID}/   { *lval += "I" }
+/{NUM}/  { *lval += "N" }
+/\{ID}/  { *lval += "B" }
+/./      { *lval += "." }
+`, "x1 3.14 {ID}", "I.N.B"},
+
+		// Without a definitions section, rules may have any delimiter, and braces
+		// mean what they always have.
+		{`
+qa{X}q { *lval += "Q" }
+/b{2}/ { *lval += "B" }
+/./    { *lval += "." }
+`, "a{X}bb b", "QB.."},
+
+		// Trailing context. The dots of a range are left in the input, even at
+		// the end of input.
+		{`
+/[0-9]+/\.\./ { *lval += "I" }
+/[0-9]+\.[0-9]*/ { *lval += "F" }
+/[0-9]+/ { *lval += "N" }
+/\.\./ { *lval += "R" }
+/ab/c+/ { *lval += "A" }
+/x[a-z]*/y/ { *lval += "X" }
+/./ { *lval += "." }
+`, "1..10 2.5 abccc xqy", "IRN.F.A....X."},
+
+		// A scanner that looks ahead to the end of input, whether for a match
+		// or for input no rule matches, still scans whatever follows.
+		{`
+/a/    { *lval += "A" }
+/a.*z/ { *lval += "Z" }
+/b.*z/ { *lval += "Y" }
+/d/    { *lval += "D" }
+`, "abcd", "AD"},
+
 	} {
-		id := fmt.Sprintf("%v", i)
-		s += `import "./nex_test` + id + "\"\n"
-		dieErr(t, os.Mkdir("nex_test"+id, 0777), "Mkdir")
-		// Ugly hack to import packages.
-		prog := x.prog
-		importLine := ""
-		if prog[0] != '\n' {
-			v := strings.SplitN(prog, "\n", 2)
-			prog = v[1]
-			importLine = "import " + v[0]
-		}
-		dieErr(t, ioutil.WriteFile(id+".nex", []byte(prog+`//
+		// Generate a package for the program under each set of options.
+		for k, opt := range programOptions {
+			id := fmt.Sprintf("%v_%v", i, k)
+			s += `import "./nex_test` + id + "\"\n"
+			dieErr(t, os.Mkdir("nex_test"+id, 0777), "Mkdir")
+			// Ugly hack to import packages.
+			prog := x.prog
+			importLine := ""
+			if prog[0] != '\n' {
+				v := strings.SplitN(prog, "\n", 2)
+				prog = v[1]
+				importLine = "import " + v[0]
+			}
+			dieErr(t, ioutil.WriteFile(id+".nex", []byte(prog+`//
 package nex_test`+id+`
 
 `+importLine+`
@@ -423,9 +1065,11 @@ func Go() {
   }
 }
 `), 0777), "WriteFile")
-		_, cerr := exec.Command(nexBin, "-o", filepath.Join("nex_test"+id, "tmp.go"), id+".nex").CombinedOutput()
-		dieErr(t, cerr, "nex: "+s)
-		body += "nex_test" + id + ".Go()\n"
+			args := append([]string{"-o", filepath.Join("nex_test"+id, "tmp.go")}, opt...)
+			_, cerr := exec.Command(nexBin, append(args, id+".nex")...).CombinedOutput()
+			dieErr(t, cerr, "nex: "+s)
+			body += "nex_test" + id + ".Go()\n"
+		}
 	}
 	s += "func main() {\n" + body + "}\n"
 	err = ioutil.WriteFile("tmp.go", []byte(s), 0777)
@@ -434,6 +1078,56 @@ func Go() {
 	dieErr(t, err, string(output))
 }
 
+// A lexer for benchmarks that counts the tokens of its input.
+var benchProgram = `/[0-9]+/          { n++ }
+/[0-9]+\.[0-9]*/  { n++ }
+/if|then|begin|end|procedure|function/
+                  { n++ }
+/[a-z][a-z0-9]*/  { n++ }
+/\+|-|\*|\//      { n++ }
+/[ \t\n]+/        { }
+/./               { n++ }
+/{[^\{\}\n]*}/    { }
+//
+package main
+import ("fmt";"os")
+func main() {
+  n := 0
+  lex := NewLexer(os.Stdin)
+  NN_FUN(lex)
+  fmt.Println(n)
+}
+`
+
+// Compare the throughput of the lexers written by each backend. Each run
+// includes starting the lexer, so the input is large.
+func BenchmarkBackends(b *testing.B) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(b, err, "TempDir")
+	defer func() {
+		dieErr(b, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "bench.nex")
+	dieErr(b, ioutil.WriteFile(spec, []byte(benchProgram), 0666), "WriteFile")
+	in := strings.Repeat("procedure foo12 { one-line comment }\nif x+1 then y := 3.14 * z2 end\n", 20000)
+	for _, backend := range []string{"closure", "table", "goto", "bytes"} {
+		src := filepath.Join(tmpdir, backend+".go")
+		bin := filepath.Join(tmpdir, backend)
+		out, err := exec.Command(nexBin, "-s", "-backend", backend, "-o", src, spec).CombinedOutput()
+		dieErr(b, err, "nex: "+string(out))
+		out, err = exec.Command("go", "build", "-o", bin, src).CombinedOutput()
+		dieErr(b, err, "go build: "+string(out))
+		b.Run(backend, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			for i := 0; i < b.N; i++ {
+				cmd := exec.Command(bin)
+				cmd.Stdin = strings.NewReader(in)
+				dieErr(b, cmd.Run(), backend)
+			}
+		})
+	}
+}
+
 func copy(dst, src string) error {
 	s, err := os.Open(src)
 	if err != nil {